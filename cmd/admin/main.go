@@ -0,0 +1,76 @@
+// Command admin manage the roles of Snippetbox users. Roles can't be given
+// from the web interface, the first admin has to sign up normally and be
+// promoted with:
+//
+//	go run ./cmd/admin -email alice@example.com -role admin
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	_ "github.com/lib/pq"
+
+	"snippetbox.kamanazan.net/internal/models"
+)
+
+func main() {
+	dsn := flag.String("dsn", "postgresql://kamanazan@localhost/snippet?sslmode=disable", "provide database connection string")
+	email := flag.String("email", "", "email of the user to change")
+	role := flag.String("role", models.RoleAdmin, "new role of the user: user, moderator or admin")
+
+	flag.Parse()
+
+	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime)
+
+	if *email == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if !models.ValidRole(*role) {
+		errorLog.Fatalf("unknown role %q", *role)
+	}
+
+	db, err := sql.Open("postgres", *dsn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	defer db.Close()
+
+	users := &models.UsersModel{DB: db}
+
+	err = users.SetRole(context.Background(), *email, *role)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			errorLog.Fatalf("no user with the email %s, sign up first", *email)
+		}
+		errorLog.Fatal(err)
+	}
+
+	// the web app write the rest of the audit log, see cmd/web/audit.go
+	details, err := json.Marshal(map[string]string{"role": *role})
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	audit := &models.AuditModel{DB: db}
+	err = audit.Insert(&models.AuditEvent{
+		Action:    "admin.role_change",
+		IP:        "local",
+		UserAgent: "cmd/admin",
+		Target:    "email:" + *email,
+		Details:   details,
+	})
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	fmt.Printf("%s is now %s\n", *email, *role)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"snippetbox.kamanazan.net/internal/models"
+)
+
+// audit record a security-relevant action in the audit log. actor is the user
+// doing the action, nil for anonymous actions like a failed login. target
+// identify what the action is about (e.g. "snippet:12") and details is
+// stored as JSON.
+//
+// A failure to write the log is reported but doesn't fail the request, the
+// action itself has already happened.
+func (app *application) audit(r *http.Request, actor *models.Users, action, target string, details map[string]any) {
+	event := &models.AuditEvent{
+		Action:    action,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Target:    target,
+	}
+
+	if actor != nil {
+		event.ActorID = actor.ID
+		event.ActorEmail = actor.Email
+	}
+
+	if details != nil {
+		data, err := json.Marshal(details)
+		if err != nil {
+			app.requestLogger(r).Error(err.Error(), "audit", action)
+			return
+		}
+		event.Details = data
+	}
+
+	err := app.auditLog.Insert(event)
+	if err != nil {
+		app.requestLogger(r).Error(err.Error(), "audit", action)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+// Use a custom type for the context keys instead of a plain string to avoid
+// collisions with keys set by third party packages.
+type contextKey string
+
+const isAuthenticatedContextKey = contextKey("isAuthenticated")
+
+// userContextKey hold the *models.Users of the logged in user.
+const userContextKey = contextKey("user")
+
+// requestIDContextKey hold the ID identifying the request in the logs.
+const requestIDContextKey = contextKey("requestID")
+
+// clientIPContextKey hold the IP address of the client, see realIP.
+const clientIPContextKey = contextKey("clientIP")
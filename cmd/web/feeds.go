@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+
+	"snippetbox.kamanazan.net/internal/models"
+)
+
+// feed hold everything needed to render a list of snippets as an Atom or RSS
+// document. Path is the page the feed mirror (e.g. "/") and SelfPath the URL
+// of the feed itself, both relative to the site root.
+type feed struct {
+	Title    string
+	Author   string
+	Path     string
+	SelfPath string
+	Snippets []*models.Snippet
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string   `xml:"title"`
+	ID        string   `xml:"id"`
+	Link      atomLink `xml:"link"`
+	Published string   `xml:"published"`
+	Updated   string   `xml:"updated"`
+	Content   atomText `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// updated returns the creation time of the newest snippet in the feed. Snippets
+// can't be edited so it is also the last time the feed content changed.
+func (f *feed) updated() time.Time {
+	var updated time.Time
+	for _, s := range f.Snippets {
+		if s.Created.After(updated) {
+			updated = s.Created
+		}
+	}
+	return updated
+}
+
+func (f *feed) atom(baseURL string) any {
+	updated := f.updated()
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+
+	doc := &atomFeed{
+		Title:   f.Title,
+		ID:      baseURL + f.SelfPath,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: baseURL + f.SelfPath, Rel: "self", Type: "application/atom+xml"},
+			{Href: baseURL + f.Path, Rel: "alternate", Type: "text/html"},
+		},
+		Author: atomAuthor{Name: f.Author},
+	}
+
+	for _, s := range f.Snippets {
+		link := fmt.Sprintf("%s/snippet/view/%d", baseURL, s.ID)
+		doc.Entries = append(doc.Entries, atomEntry{
+			Title:     s.Title,
+			ID:        link,
+			Link:      atomLink{Href: link, Rel: "alternate"},
+			Published: s.Created.UTC().Format(time.RFC3339),
+			Updated:   s.Created.UTC().Format(time.RFC3339),
+			Content:   atomText{Type: "text", Body: s.Content},
+		})
+	}
+
+	return doc
+}
+
+func (f *feed) rss(baseURL string) any {
+	updated := f.updated()
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+
+	doc := &rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          baseURL + f.Path,
+			Description:   f.Title,
+			LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+
+	for _, s := range f.Snippets {
+		link := fmt.Sprintf("%s/snippet/view/%d", baseURL, s.ID)
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			Title:       s.Title,
+			Link:        link,
+			GUID:        rssGUID{IsPermaLink: true, Value: link},
+			PubDate:     s.Created.UTC().Format(time.RFC1123Z),
+			Description: s.Content,
+		})
+	}
+
+	return doc
+}
+
+// serveFeed write the feed in the requested format ("atom" or "rss").
+// http.ServeContent take care of the conditional GET headers: Last-Modified is
+// the newest snippet and the ETag change whenever a snippet enter or leave the
+// feed (an expired snippet doesn't change Last-Modified).
+func (app *application) serveFeed(w http.ResponseWriter, r *http.Request, f *feed, format string) {
+	var doc any
+	var contentType string
+
+	switch format {
+	case "atom":
+		doc = f.atom(app.baseURL)
+		contentType = "application/atom+xml; charset=utf-8"
+	case "rss":
+		doc = f.rss(app.baseURL)
+		contentType = "application/rss+xml; charset=utf-8"
+	default:
+		app.notFound(w)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(xml.Header)
+
+	err := xml.NewEncoder(buf).Encode(doc)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	hash := sha256.New()
+	for _, s := range f.Snippets {
+		fmt.Fprintf(hash, "%d,", s.ID)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", fmt.Sprintf(`W/"%s-%s"`, format, hex.EncodeToString(hash.Sum(nil))[:16]))
+
+	http.ServeContent(w, r, "", f.updated(), bytes.NewReader(buf.Bytes()))
+}
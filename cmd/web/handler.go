@@ -1,13 +1,32 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"math"
 	"net/http"
+	"net/url"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/julienschmidt/httprouter"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/oauth2"
+	"snippetbox.kamanazan.net/internal/mailer"
 	"snippetbox.kamanazan.net/internal/models"
+	"snippetbox.kamanazan.net/internal/policy"
+	"snippetbox.kamanazan.net/internal/totp"
 	"snippetbox.kamanazan.net/internal/validator"
 )
 
@@ -20,6 +39,10 @@ type snippetCreateForm struct {
 	Title   string `form:"title"`
 	Content string `form:"content"`
 	Expired int    `form:"expired"`
+	// set when the content looks like it contains secrets, PublishSecrets
+	// confirm the user wants to publish them anyway
+	SecretsFound   bool `form:"-"`
+	PublishSecrets bool `form:"publish_secrets"`
 	// embed struct here, so snippetCreateForm "inherit" everything in Validator
 	validator.Validator `form:"-"`
 }
@@ -31,34 +54,83 @@ type userSignUpForm struct {
 	validator.Validator `form:"-"`
 }
 
+type collectionForm struct {
+	Name                string `form:"name"`
+	Description         string `form:"description"`
+	Visibility          string `form:"visibility"`
+	validator.Validator `form:"-"`
+}
+
+type passwordForgotForm struct {
+	Email               string `form:"email"`
+	validator.Validator `form:"-"`
+}
+
+type passwordResetForm struct {
+	Password            string `form:"password"`
+	Token               string `form:"-"`
+	validator.Validator `form:"-"`
+}
+
+type twoFactorForm struct {
+	Code                string `form:"code"`
+	validator.Validator `form:"-"`
+}
+
+type accountForm struct {
+	Name                string `form:"name"`
+	Email               string `form:"email"`
+	CurrentPassword     string `form:"current_password"`
+	validator.Validator `form:"-"`
+}
+
+type passwordUpdateForm struct {
+	CurrentPassword         string `form:"current_password"`
+	NewPassword             string `form:"new_password"`
+	NewPasswordConfirmation string `form:"new_password_confirmation"`
+	validator.Validator     `form:"-"`
+}
+
+type reportForm struct {
+	Reason              string `form:"reason"`
+	validator.Validator `form:"-"`
+}
+
 type userLoginForm struct {
 	Email               string `form:"email"`
-	Password            string `form:"pasword"`
+	Password            string `form:"password"`
 	validator.Validator `form:"-"`
 }
 
 // with  this all function here will be method for 'application' struct and have access
 // to centralized logging.
 func (app *application) home(w http.ResponseWriter, r *http.Request) {
-	snippets, err := app.snippet.Latest()
+	snippets, err := app.snippet.Latest(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	mostStarred, err := app.snippet.MostStarred(r.Context(), 7)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
-	data := app.newTemplateData()
+	data := app.newTemplateData(r)
 	data.Snippets = snippets
+	data.MostStarred = mostStarred
 
-	app.render(w, http.StatusOK, "home.html", data)
+	app.render(w, r, http.StatusOK, "home.html", data)
 
 }
 
 func (app *application) createSnippet(w http.ResponseWriter, r *http.Request) {
-	data := app.newTemplateData()
+	data := app.newTemplateData(r)
 	data.Form = snippetCreateForm{
 		Expired: 1,
 	}
-	app.render(w, http.StatusOK, "create.html", data)
+	app.render(w, r, http.StatusOK, "create.html", data)
 }
 
 func (app *application) createSnippetPost(w http.ResponseWriter, r *http.Request) {
@@ -76,20 +148,84 @@ func (app *application) createSnippetPost(w http.ResponseWriter, r *http.Request
 	validDuration := []int{1, 7, 365}
 	form.CheckField(validator.ValueInRange(form.Expired, validDuration), "expired", "This field must equal 1, 7 or 365")
 
+	found := app.scanSecrets(&form)
+
 	if !form.Valid() {
-		data := app.newTemplateData()
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "create.html", data)
+		return
+	}
+
+	wait, err := app.takeSnippetQuota(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if wait > 0 {
+		minutes := int(math.Ceil(wait.Minutes()))
+		form.AddNonFieldError(fmt.Sprintf("You created too many snippets. Please try again in %d minute(s).", minutes))
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusTooManyRequests, "create.html", data)
+		return
+	}
+
+	verdict, err := app.evaluateSnippet(r, &form)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if verdict.Decision == policy.Reject {
+		app.audit(r, app.authenticatedUser(r), "snippet.reject", "", map[string]any{"title": form.Title, "score": verdict.Score, "reasons": verdict.Reasons})
+
+		form.AddNonFieldError("This snippet looks like spam and can't be published.")
+
+		data := app.newTemplateData(r)
 		data.Form = form
-		app.render(w, http.StatusUnprocessableEntity, "create.html", data)
+		app.render(w, r, http.StatusUnprocessableEntity, "create.html", data)
 		return
 	}
 
-	id, err := app.snippet.Insert(form.Title, form.Content, form.Expired)
+	// Suspicious snippets are kept out of sight until a moderator look at
+	// them, like the snippets hidden after too many reports.
+	var id int
+	if verdict.Decision == policy.Quarantine {
+		id, err = app.snippet.InsertQuarantined(r.Context(), form.Title, form.Content, form.Expired, app.authenticatedUserID(r), policyReason(verdict))
+	} else {
+		id, err = app.snippet.Insert(r.Context(), form.Title, form.Content, form.Expired, app.authenticatedUserID(r))
+	}
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
+		return
+	}
+
+	details := map[string]any{"title": form.Title}
+	if len(found) > 0 {
+		details["secrets"] = len(found)
+		details["secret_scan"] = app.secretScan
+	}
+	app.audit(r, app.authenticatedUser(r), "snippet.create", fmt.Sprintf("snippet:%d", id), details)
+	app.metrics.snippetsCreated.Inc()
+
+	if verdict.Decision == policy.Quarantine {
+		app.audit(r, nil, "snippet.quarantine", fmt.Sprintf("snippet:%d", id), map[string]any{"score": verdict.Score, "reasons": verdict.Reasons})
+
+		app.sessionManager.Put(r.Context(), "flash", "Snippet Created. It will be published once a moderator has reviewed it.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	app.sessionManager.Put(r.Context(), "flash", "Snippet Created")
+	flash := "Snippet Created"
+	if len(found) > 0 && app.secretScan == secretScanRedact {
+		flash = fmt.Sprintf("Snippet Created, %d secret(s) were redacted: %s", len(found), describeSecrets(found))
+	}
+	app.sessionManager.Put(r.Context(), "flash", flash)
 
 	http.Redirect(w, r, fmt.Sprintf("/snippet/view/%d", id), http.StatusSeeOther)
 }
@@ -102,31 +238,47 @@ func (app *application) viewSnippet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	snippet, err := app.snippet.Get(id)
+	snippet, err := app.snippet.Get(r.Context(), id)
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecord) {
 			app.notFound(w)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
 
-	flash := app.sessionManager.PopString(r.Context(), "flash")
+	app.viewRecorder.Record(r, snippet.ID)
+
+	starred, err := app.star.Exists(app.authenticatedUserID(r), snippet.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
 
-	data := app.newTemplateData()
+	data := app.newTemplateData(r)
 	data.Snippet = snippet
-	data.FlashMsg = flash
+	data.Starred = starred
+	data.IsOwner = snippet.UserID != 0 && snippet.UserID == app.authenticatedUserID(r)
+	data.CanDelete = app.canDeleteSnippet(r, snippet)
+
+	if data.IsAuthenticated {
+		data.Collections, err = app.collection.ByUser(app.authenticatedUserID(r))
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
 
-	app.render(w, http.StatusOK, "view.html", data)
+	app.render(w, r, http.StatusOK, "view.html", data)
 
 }
 
 func (app *application) userSignup(w http.ResponseWriter, r *http.Request) {
-	data := app.newTemplateData()
+	data := app.newTemplateData(r)
 	data.Form = userSignUpForm{}
 
-	app.render(w, http.StatusOK, "signup.html", data)
+	app.render(w, r, http.StatusOK, "signup.html", data)
 }
 
 func (app *application) userSignupPost(w http.ResponseWriter, r *http.Request) {
@@ -148,38 +300,2369 @@ func (app *application) userSignupPost(w http.ResponseWriter, r *http.Request) {
 	// If there are any errors, redisplay the signup form along with a 422
 	// status code.
 	if !form.Valid() {
-		data := app.newTemplateData()
+		data := app.newTemplateData(r)
 		data.Form = form
-		app.render(w, http.StatusUnprocessableEntity, "signup.html", data)
+		app.render(w, r, http.StatusUnprocessableEntity, "signup.html", data)
 		return
 	}
-	// Otherwise send the placeholder response (for now!).
 
-	err = app.user.Insert(form.Name, form.Email, form.Password)
+	id, err := app.user.Insert(r.Context(), form.Name, form.Email, form.Password)
 	if err != nil {
-		fmt.Printf("is error %s %v", err, errors.Is(err, models.ErrDuplicateEmail))
 		if errors.Is(err, models.ErrDuplicateEmail) {
-			data := app.newTemplateData()
+			data := app.newTemplateData(r)
 			form.AddFieldError("email", "Email already exist")
 			data.Form = form
-			app.render(w, http.StatusUnprocessableEntity, "signup.html", data)
+			app.render(w, r, http.StatusUnprocessableEntity, "signup.html", data)
 			return
-
 		}
+
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, &models.Users{ID: id, Email: form.Email}, "user.signup", fmt.Sprintf("user:%d", id), nil)
+
+	_, err = app.sendVerificationMail(r, &models.Users{ID: id, Name: form.Name, Email: form.Email})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
 	}
-	http.Redirect(w, r, "/", http.StatusAccepted)
+
+	app.sessionManager.Put(r.Context(), "flash", "Your signup was successful. Check your email to verify your address, then log in.")
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 }
 
 func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
-	data := app.newTemplateData()
+	data := app.newTemplateData(r)
 	data.Form = userLoginForm{}
-	app.render(w, http.StatusOK, "login.html", data)
+	app.render(w, r, http.StatusOK, "login.html", data)
 }
 
 func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "Authenticate and login the user...")
+	var form userLoginForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.StringNotEmpty(form.Email), "email", "This field cannot be blank")
+	form.CheckField(validator.ValidEmail(form.Email), "email", "This field must be a valid email address")
+	form.CheckField(validator.StringNotEmpty(form.Password), "password", "This field cannot be blank")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "login.html", data)
+		return
+	}
+
+	// The lock is checked before the password so a locked account can't be
+	// used to guess it. The message is the same whether the email has an
+	// account or not.
+	lock, err := app.loginLockedFor(r, form.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if lock > 0 {
+		app.audit(r, nil, "user.login_failed", "email:"+form.Email, map[string]any{"reason": "locked"})
+
+		minutes := int(math.Ceil(lock.Minutes()))
+		form.AddNonFieldError(fmt.Sprintf("Too many failed login attempts. Please try again in %d minute(s).", minutes))
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(lock.Seconds())+1))
+
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusTooManyRequests, "login.html", data)
+		return
+	}
+
+	id, err := app.user.Authenticate(r.Context(), form.Email, form.Password)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			app.audit(r, nil, "user.login_failed", "email:"+form.Email, map[string]any{"reason": "invalid credentials"})
+
+			err = app.loginFailed(r, form.Email)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+
+			form.AddNonFieldError("Email or password is incorrect")
+
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, r, http.StatusUnprocessableEntity, "login.html", data)
+		} else if errors.Is(err, models.ErrAccountDisabled) {
+			app.audit(r, nil, "user.login_failed", "email:"+form.Email, map[string]any{"reason": "disabled"})
+
+			form.AddNonFieldError("This account has been disabled")
+
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, r, http.StatusForbidden, "login.html", data)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.user.Get(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// With two-factor authentication the password is only the first step, the
+	// session is partially authenticated until a valid code is given. The
+	// failures of the account are kept until then, a valid password alone
+	// must not give more tries at the code.
+	if user.TOTPEnabled {
+		// Change the session ID whenever the authentication state changes to
+		// prevent session fixation attacks.
+		err = app.sessionManager.RenewToken(r.Context())
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		app.sessionManager.Put(r.Context(), "twoFactorUserID", id)
+		app.sessionManager.Put(r.Context(), "twoFactorExpires", time.Now().Add(5*time.Minute).Unix())
+		app.sessionManager.Put(r.Context(), "twoFactorAttempts", 0)
+
+		http.Redirect(w, r, "/user/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	err = app.loginSucceeded(form.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.logIn(r, id, "password")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/snippet/create", http.StatusSeeOther)
+}
+
+// pendingTwoFactorUser returns the user who gave a valid password but not yet
+// a second factor, or 0 when there is none or it took too long.
+func (app *application) pendingTwoFactorUser(r *http.Request) int {
+	id := app.sessionManager.GetInt(r.Context(), "twoFactorUserID")
+	if id == 0 || time.Now().Unix() > app.sessionManager.GetInt64(r.Context(), "twoFactorExpires") {
+		return 0
+	}
+	return id
+}
+
+func (app *application) clearTwoFactorLogin(r *http.Request) {
+	app.sessionManager.Remove(r.Context(), "twoFactorUserID")
+	app.sessionManager.Remove(r.Context(), "twoFactorExpires")
+	app.sessionManager.Remove(r.Context(), "twoFactorAttempts")
+}
+
+func (app *application) userLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if app.pendingTwoFactorUser(r) == 0 {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = twoFactorForm{}
+	app.render(w, r, http.StatusOK, "login_2fa.html", data)
+}
+
+func (app *application) userLoginTwoFactorPost(w http.ResponseWriter, r *http.Request) {
+	id := app.pendingTwoFactorUser(r)
+	if id == 0 {
+		app.clearTwoFactorLogin(r)
+		app.sessionManager.Put(r.Context(), "flash", "Your login expired, please try again.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	var form twoFactorForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.user.Get(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// The codes are guessed against the same counters as the passwords, once
+	// locked the whole login has to be done again.
+	lock, err := app.loginLockedFor(r, user.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if lock > 0 {
+		app.audit(r, nil, "user.login_failed", fmt.Sprintf("user:%d", id), map[string]any{"reason": "locked"})
+
+		app.clearTwoFactorLogin(r)
+		minutes := int(math.Ceil(lock.Minutes()))
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Too many failed login attempts. Please try again in %d minute(s).", minutes))
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	ok, err := app.checkTwoFactorCode(r.Context(), id, form.Code)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.audit(r, nil, "user.login_failed", fmt.Sprintf("user:%d", id), map[string]any{"reason": "invalid two-factor code"})
+
+		err = app.loginFailed(r, user.Email)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		// a few attempts only, then the password has to be given again
+		attempts := app.sessionManager.GetInt(r.Context(), "twoFactorAttempts") + 1
+		if attempts >= 5 {
+			app.clearTwoFactorLogin(r)
+			app.sessionManager.Put(r.Context(), "flash", "Too many invalid codes, please log in again.")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "twoFactorAttempts", attempts)
+
+		form.AddNonFieldError("This code is not valid")
+
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "login_2fa.html", data)
+		return
+	}
+
+	app.clearTwoFactorLogin(r)
+
+	err = app.loginSucceeded(user.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.logIn(r, id, "password+totp")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/snippet/create", http.StatusSeeOther)
 }
 
 func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "Logout the user...")
+	err := app.userSession.DeleteByToken(app.sessionManager.Token(r.Context()))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+	app.sessionManager.Put(r.Context(), "flash", "You've been logged out successfully!")
+
+	app.audit(r, app.authenticatedUser(r), "user.logout", fmt.Sprintf("user:%d", app.authenticatedUserID(r)), nil)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) userStarred(w http.ResponseWriter, r *http.Request) {
+	snippets, err := app.snippet.StarredBy(r.Context(), app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Snippets = snippets
+
+	app.render(w, r, http.StatusOK, "starred.html", data)
+}
+
+func (app *application) starSnippetPost(w http.ResponseWriter, r *http.Request) {
+	app.toggleStar(w, r, true)
+}
+
+func (app *application) unstarSnippetPost(w http.ResponseWriter, r *http.Request) {
+	app.toggleStar(w, r, false)
+}
+
+// toggleStar add or remove the star of the logged in user on the snippet in
+// the URL, then send the user back to the snippet.
+func (app *application) toggleStar(w http.ResponseWriter, r *http.Request, star bool) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	// make sure we don't star an expired or non existing snippet
+	_, err = app.snippet.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	if star {
+		err = app.star.Insert(userID, id)
+	} else {
+		err = app.star.Delete(userID, id)
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/snippet/view/%d", id), http.StatusSeeOther)
+}
+
+func (app *application) userCollections(w http.ResponseWriter, r *http.Request) {
+	collections, err := app.collection.ByUser(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Collections = collections
+	data.Form = collectionForm{
+		Visibility: "public",
+	}
+
+	app.render(w, r, http.StatusOK, "collections.html", data)
+}
+
+func (app *application) userCollectionsPost(w http.ResponseWriter, r *http.Request) {
+	var form collectionForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	slug := slugify(form.Name)
+
+	form.CheckField(validator.StringNotEmpty(form.Name), "name", "This field cannot be blank")
+	form.CheckField(validator.StringInLimit(form.Name, 150), "name", "This field can not be more than 150 characters")
+	form.CheckField(slug != "", "name", "This field must contain at least one letter or digit")
+	form.CheckField(validator.PermittedValue(form.Visibility, "public", "private"), "visibility", "This field must equal public or private")
+
+	userID := app.authenticatedUserID(r)
+
+	if form.Valid() {
+		id, err := app.collection.Insert(userID, form.Name, slug, form.Description, form.Visibility)
+		if err == nil {
+			app.sessionManager.Put(r.Context(), "flash", "Collection Created")
+			http.Redirect(w, r, fmt.Sprintf("/collection/%d-%s/edit", id, slug), http.StatusSeeOther)
+			return
+		}
+
+		if !errors.Is(err, models.ErrDuplicateSlug) {
+			app.serverError(w, r, err)
+			return
+		}
+		form.AddFieldError("name", "You already have a collection with a similar name")
+	}
+
+	collections, err := app.collection.ByUser(userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Collections = collections
+	data.Form = form
+	app.render(w, r, http.StatusUnprocessableEntity, "collections.html", data)
+}
+
+func (app *application) viewCollection(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, ok := collectionID(params.ByName("ref"))
+	if !ok {
+		app.notFound(w)
+		return
+	}
+
+	collection, err := app.collection.Get(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// private collections are reported as missing instead of forbidden so
+	// their existence is not leaked
+	if !collection.IsPublic() && collection.UserID != app.authenticatedUserID(r) {
+		app.notFound(w)
+		return
+	}
+
+	snippets, err := app.snippet.InCollection(r.Context(), collection.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Collection = collection
+	data.Snippets = snippets
+	data.IsOwner = collection.UserID == app.authenticatedUserID(r)
+
+	app.render(w, r, http.StatusOK, "collection.html", data)
+}
+
+func (app *application) editCollection(w http.ResponseWriter, r *http.Request) {
+	collection, ok := app.ownedCollection(w, r)
+	if !ok {
+		return
+	}
+
+	snippets, err := app.snippet.InCollection(r.Context(), collection.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Collection = collection
+	data.Snippets = snippets
+	data.Form = collectionForm{
+		Name:        collection.Name,
+		Description: collection.Description,
+		Visibility:  collection.Visibility,
+	}
+
+	app.render(w, r, http.StatusOK, "collection_edit.html", data)
+}
+
+func (app *application) editCollectionPost(w http.ResponseWriter, r *http.Request) {
+	collection, ok := app.ownedCollection(w, r)
+	if !ok {
+		return
+	}
+
+	var form collectionForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.StringNotEmpty(form.Name), "name", "This field cannot be blank")
+	form.CheckField(validator.StringInLimit(form.Name, 150), "name", "This field can not be more than 150 characters")
+	form.CheckField(validator.PermittedValue(form.Visibility, "public", "private"), "visibility", "This field must equal public or private")
+
+	if !form.Valid() {
+		snippets, err := app.snippet.InCollection(r.Context(), collection.ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		data := app.newTemplateData(r)
+		data.Collection = collection
+		data.Snippets = snippets
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "collection_edit.html", data)
+		return
+	}
+
+	err = app.collection.Update(collection.ID, form.Name, form.Description, form.Visibility)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Collection Updated")
+
+	http.Redirect(w, r, "/collection/"+collection.Ref()+"/edit", http.StatusSeeOther)
+}
+
+func (app *application) reorderCollectionPost(w http.ResponseWriter, r *http.Request) {
+	collection, ok := app.ownedCollection(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// main.js send the new order as a comma separated list of snippet IDs
+	var snippetIDs []int
+	for _, field := range strings.Split(r.PostForm.Get("order"), ",") {
+		if field == "" {
+			continue
+		}
+
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+		snippetIDs = append(snippetIDs, id)
+	}
+
+	err = app.collection.Reorder(collection.ID, snippetIDs)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Collection Reordered")
+
+	http.Redirect(w, r, "/collection/"+collection.Ref()+"/edit", http.StatusSeeOther)
+}
+
+func (app *application) removeFromCollectionPost(w http.ResponseWriter, r *http.Request) {
+	collection, ok := app.ownedCollection(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	snippetID, err := strconv.Atoi(r.PostForm.Get("snippet_id"))
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.collection.RemoveSnippet(collection.ID, snippetID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/collection/"+collection.Ref()+"/edit", http.StatusSeeOther)
+}
+
+func (app *application) deleteCollectionPost(w http.ResponseWriter, r *http.Request) {
+	collection, ok := app.ownedCollection(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.collection.Delete(collection.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Collection Deleted")
+
+	http.Redirect(w, r, "/user/collections", http.StatusSeeOther)
+}
+
+func (app *application) collectSnippetPost(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	collectionID, err := strconv.Atoi(r.PostForm.Get("collection"))
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	collection, err := app.collection.Get(collectionID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusBadRequest)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	if collection.UserID != app.authenticatedUserID(r) {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	_, err = app.snippet.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	err = app.collection.AddSnippet(collection.ID, id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Snippet added to %s", collection.Name))
+
+	http.Redirect(w, r, fmt.Sprintf("/snippet/view/%d", id), http.StatusSeeOther)
+}
+
+func (app *application) snippetAnalytics(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	snippet, err := app.snippet.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// analytics are only visible to the owner of the snippet
+	if snippet.UserID == 0 || snippet.UserID != app.authenticatedUserID(r) {
+		app.notFound(w)
+		return
+	}
+
+	total, err := app.view.Total(snippet.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	daily, err := app.view.Daily(snippet.ID, 30)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	referrers, err := app.view.Referrers(snippet.ID, 30)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Snippet = snippet
+	data.TotalViews = total
+	data.DailyViews = daily
+	data.Referrers = referrers
+
+	app.render(w, r, http.StatusOK, "analytics.html", data)
+}
+
+func (app *application) feedAtom(w http.ResponseWriter, r *http.Request) {
+	app.latestFeed(w, r, "atom")
+}
+
+func (app *application) feedRSS(w http.ResponseWriter, r *http.Request) {
+	app.latestFeed(w, r, "rss")
+}
+
+func (app *application) latestFeed(w http.ResponseWriter, r *http.Request, format string) {
+	snippets, err := app.snippet.Latest(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.serveFeed(w, r, &feed{
+		Title:    "Snippetbox - Latest Snippets",
+		Author:   "Snippetbox",
+		Path:     "/",
+		SelfPath: "/feed." + format,
+		Snippets: snippets,
+	}, format)
+}
+
+func (app *application) userFeed(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	user, err := app.user.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	snippets, err := app.snippet.LatestByUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	format := params.ByName("format")
+
+	app.serveFeed(w, r, &feed{
+		Title:    fmt.Sprintf("Snippetbox - Snippets by %s", user.Name),
+		Author:   user.Name,
+		Path:     "/",
+		SelfPath: fmt.Sprintf("/feed/user/%d/%s", user.ID, format),
+		Snippets: snippets,
+	}, format)
+}
+
+func (app *application) embedSnippet(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	snippet, err := app.snippet.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// the embed page has no session, so don't go through newTemplateData()
+	data := &templateData{
+		Snippet: snippet,
+	}
+
+	app.render(w, r, http.StatusOK, "embed.html", data)
+}
+
+// oembed implements the provider side of https://oembed.com for snippet
+// pages. Only the JSON format is supported.
+func (app *application) oembed(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format != "" && format != "json" {
+		app.clientError(w, http.StatusNotImplemented)
+		return
+	}
+
+	// only answer for the snippets of this instance, the Host header of the
+	// request is chosen by the client and can't tell
+	site, err := url.Parse(app.baseURL)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	target, err := url.Parse(query.Get("url"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || !strings.EqualFold(target.Host, site.Host) {
+		app.notFound(w)
+		return
+	}
+
+	idParam, found := strings.CutPrefix(target.Path, "/snippet/view/")
+	if !found {
+		idParam, found = strings.CutPrefix(target.Path, "/snippet/embed/")
+	}
+
+	id, err := strconv.Atoi(idParam)
+	if !found || err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	snippet, err := app.snippet.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	width, height := 600, 300
+	if maxWidth, err := strconv.Atoi(query.Get("maxwidth")); err == nil && maxWidth > 0 && maxWidth < width {
+		width = maxWidth
+	}
+	if maxHeight, err := strconv.Atoi(query.Get("maxheight")); err == nil && maxHeight > 0 && maxHeight < height {
+		height = maxHeight
+	}
+
+	embedURL := fmt.Sprintf("%s/snippet/embed/%d", app.baseURL, snippet.ID)
+
+	resp := map[string]any{
+		"version":       "1.0",
+		"type":          "rich",
+		"title":         snippet.Title,
+		"provider_name": "Snippetbox",
+		"provider_url":  app.baseURL + "/",
+		"cache_age":     3600,
+		"width":         width,
+		"height":        height,
+		"html": fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" frameborder="0" title="%s"></iframe>`,
+			embedURL, width, height, template.HTMLEscapeString(snippet.Title)),
+	}
+
+	app.writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (app *application) passwordForgot(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = passwordForgotForm{}
+	app.render(w, r, http.StatusOK, "password_forgot.html", data)
+}
+
+func (app *application) passwordForgotPost(w http.ResponseWriter, r *http.Request) {
+	var form passwordForgotForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.StringNotEmpty(form.Email), "email", "This field cannot be blank")
+	form.CheckField(validator.ValidEmail(form.Email), "email", "This field must be a valid email address")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "password_forgot.html", data)
+		return
+	}
+
+	user, err := app.user.GetByEmail(r.Context(), form.Email)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if user != nil {
+		token, err := app.token.New(user.ID, models.ScopePasswordReset, time.Hour)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		app.audit(r, nil, "token.create", fmt.Sprintf("user:%d", user.ID), map[string]any{"scope": models.ScopePasswordReset})
+
+		link := fmt.Sprintf("%s/user/password/reset/%s", app.baseURL, token)
+
+		// sending the mail in the background keep the response time the
+		// same whether the account exists or not
+		app.background(func() {
+			err := app.mailer.Send(mailer.Message{
+				To:      user.Email,
+				Subject: "Reset your Snippetbox password",
+				Body: fmt.Sprintf("Hi %s,\n\nSomebody asked to reset the password of your Snippetbox account. "+
+					"If it was you, follow the link below within the next hour:\n\n%s\n\n"+
+					"If it wasn't you, you can ignore this message.\n", user.Name, link),
+			})
+			if err != nil {
+				app.requestLogger(r).Error(err.Error())
+			}
+		})
+	}
+
+	// Same message whether the email is known or not, so the form can't be
+	// used to find out who has an account.
+	app.sessionManager.Put(r.Context(), "flash", "If an account exists for this email, a reset link is on its way.")
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+func (app *application) passwordReset(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	token := params.ByName("token")
+
+	_, err := app.token.Check(token, models.ScopePasswordReset)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.sessionManager.Put(r.Context(), "flash", "This reset link is invalid or has expired.")
+			http.Redirect(w, r, "/user/password/forgot", http.StatusSeeOther)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = passwordResetForm{Token: token}
+	app.render(w, r, http.StatusOK, "password_reset.html", data)
+}
+
+func (app *application) passwordResetPost(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	var form passwordResetForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Token = params.ByName("token")
+
+	// Same rules as signup.
+	form.CheckField(validator.StringNotEmpty(form.Password), "password", "This field cannot be blank")
+	form.CheckField(validator.MinChars(form.Password, 8), "password", "This field must be at least 8 characters long")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "password_reset.html", data)
+		return
+	}
+
+	userID, err := app.token.ResetPassword(form.Token, form.Password)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.sessionManager.Put(r.Context(), "flash", "This reset link is invalid or has expired.")
+			http.Redirect(w, r, "/user/password/forgot", http.StatusSeeOther)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// whoever knew the old password must not stay logged in
+	err = app.signOutSessions(r, userID, true)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, nil, "user.password_reset", fmt.Sprintf("user:%d", userID), nil)
+
+	app.sessionManager.Put(r.Context(), "flash", "Your password has been reset. Please log in.")
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+func (app *application) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	id, err := strconv.Atoi(query.Get("id"))
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.user.Get(r.Context(), id)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	valid := user != nil && time.Now().Unix() < expires &&
+		hmac.Equal([]byte(query.Get("sig")), []byte(app.verificationSignature(user.ID, user.Email, expires)))
+
+	if !valid {
+		app.sessionManager.Put(r.Context(), "flash", "This verification link is invalid or has expired.")
+		http.Redirect(w, r, "/user/verify/pending", http.StatusSeeOther)
+		return
+	}
+
+	err = app.user.MarkVerified(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your email address has been verified.")
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) verifyPending(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.User = app.authenticatedUser(r)
+	app.render(w, r, http.StatusOK, "verify.html", data)
+}
+
+func (app *application) verifyResendPost(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	if user.Verified {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	sent, err := app.sendVerificationMail(r, user)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if sent {
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("A new verification link has been sent to %s.", user.Email))
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", "A verification link was sent a few minutes ago, please wait before asking for another one.")
+	}
+
+	http.Redirect(w, r, "/user/verify/pending", http.StatusSeeOther)
+}
+
+func (app *application) twoFactor(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	remaining, err := app.recoveryCode.Remaining(user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.TwoFactorAvailable = app.encryptionKey != nil
+	data.RecoveryCodesLeft = remaining
+	data.Form = twoFactorForm{}
+
+	app.render(w, r, http.StatusOK, "2fa.html", data)
+}
+
+func (app *application) twoFactorSetupPost(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	if app.encryptionKey == nil || user.TOTPEnabled {
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	encrypted, err := app.encrypt([]byte(secret))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.user.SetTOTPSecret(r.Context(), user.ID, encrypted)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+}
+
+func (app *application) twoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	if user.TOTPEnabled {
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	secret, err := app.totpSecret(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if secret == "" {
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.TOTPSecret = secret
+	data.Form = twoFactorForm{}
+
+	app.render(w, r, http.StatusOK, "2fa_setup.html", data)
+}
+
+// twoFactorQR serve the QR code of the secret being enrolled. It is a
+// separate image rather than a data: URI which the CSP would block.
+func (app *application) twoFactorQR(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	// once enabled the secret is never displayed again
+	if user.TOTPEnabled {
+		app.notFound(w)
+		return
+	}
+
+	secret, err := app.totpSecret(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if secret == "" {
+		app.notFound(w)
+		return
+	}
+
+	png, err := qrcode.Encode(totp.URI("Snippetbox", user.Email, secret), qrcode.Medium, 256)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+func (app *application) twoFactorEnablePost(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	if user.TOTPEnabled {
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	var form twoFactorForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	secret, err := app.totpSecret(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if secret == "" {
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	// only codes from the authenticator app are accepted here, the user has
+	// no recovery codes yet
+	step, ok := totp.Validate(secret, form.Code, time.Now())
+	if ok {
+		ok, err = app.user.UseTOTPStep(r.Context(), user.ID, step)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	if !ok {
+		form.AddFieldError("code", "This code is not valid, check the clock of your device")
+
+		data := app.newTemplateData(r)
+		data.User = user
+		data.TOTPSecret = secret
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "2fa_setup.html", data)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(10)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.recoveryCode.Replace(user.ID, codes)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.user.EnableTOTP(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, user, "user.2fa_enable", fmt.Sprintf("user:%d", user.ID), nil)
+
+	// the recovery codes are displayed once, right now
+	data := app.newTemplateData(r)
+	data.RecoveryCodes = codes
+	data.FlashMsg = "Two-factor authentication is enabled"
+	app.render(w, r, http.StatusOK, "2fa_recovery.html", data)
+}
+
+func (app *application) twoFactorRecoveryPost(w http.ResponseWriter, r *http.Request) {
+	app.twoFactorConfirmed(w, r, func(user *models.Users) bool {
+		codes, err := generateRecoveryCodes(10)
+		if err != nil {
+			app.serverError(w, r, err)
+			return false
+		}
+
+		err = app.recoveryCode.Replace(user.ID, codes)
+		if err != nil {
+			app.serverError(w, r, err)
+			return false
+		}
+
+		app.audit(r, user, "user.2fa_recovery_codes", fmt.Sprintf("user:%d", user.ID), nil)
+
+		data := app.newTemplateData(r)
+		data.RecoveryCodes = codes
+		app.render(w, r, http.StatusOK, "2fa_recovery.html", data)
+		return false
+	})
+}
+
+func (app *application) twoFactorDisablePost(w http.ResponseWriter, r *http.Request) {
+	app.twoFactorConfirmed(w, r, func(user *models.Users) bool {
+		err := app.user.DisableTOTP(r.Context(), user.ID)
+		if err == nil {
+			err = app.recoveryCode.DeleteAll(user.ID)
+		}
+		if err != nil {
+			app.serverError(w, r, err)
+			return false
+		}
+
+		app.audit(r, user, "user.2fa_disable", fmt.Sprintf("user:%d", user.ID), nil)
+
+		app.sessionManager.Put(r.Context(), "flash", "Two-factor authentication is disabled")
+		return true
+	})
+}
+
+// twoFactorConfirmed run action only if the request carries a valid code of
+// the logged in user, otherwise the 2FA page is displayed again with an
+// error. action returns true when the user should be sent back to the 2FA
+// page, false when it already wrote a response.
+func (app *application) twoFactorConfirmed(w http.ResponseWriter, r *http.Request, action func(*models.Users) bool) {
+	user := app.authenticatedUser(r)
+
+	if !user.TOTPEnabled {
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	var form twoFactorForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	ok, err := app.checkTwoFactorCode(r.Context(), user.ID, form.Code)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !ok {
+		remaining, err := app.recoveryCode.Remaining(user.ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		form.AddFieldError("code", "This code is not valid")
+
+		data := app.newTemplateData(r)
+		data.User = user
+		data.TwoFactorAvailable = app.encryptionKey != nil
+		data.RecoveryCodesLeft = remaining
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "2fa.html", data)
+		return
+	}
+
+	if action(user) {
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+	}
+}
+
+func (app *application) passkeys(w http.ResponseWriter, r *http.Request) {
+	credentials, err := app.credential.ByUser(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Credentials = credentials
+	app.render(w, r, http.StatusOK, "passkeys.html", data)
+}
+
+func (app *application) passkeyRegisterBeginPost(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadWebauthnUser(app.authenticatedUser(r))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// don't let the same authenticator be registered twice
+	var exclusions []protocol.CredentialDescriptor
+	for _, c := range user.credentials {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+
+	creation, session, err := app.webauthn.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.putWebauthnSession(r, "webauthnRegistration", session)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, creation)
+}
+
+func (app *application) passkeyRegisterFinishPost(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadWebauthnUser(app.authenticatedUser(r))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	session, err := app.popWebauthnSession(r, "webauthnRegistration")
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	credential, err := app.webauthn.FinishRegistration(user, *session, r)
+	if err != nil {
+		app.writeJSON(w, r, http.StatusBadRequest, map[string]string{"error": "The passkey could not be registered"})
+		return
+	}
+
+	data, err := json.Marshal(credential)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// the name is only a label to tell the passkeys apart
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" || !validator.StringInLimit(name, 100) {
+		name = "Passkey"
+	}
+
+	err = app.credential.Insert(user.user.ID, credential.ID, name, data)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, user.user, "user.passkey_register", fmt.Sprintf("user:%d", user.user.ID), map[string]any{"name": name})
+
+	app.sessionManager.Put(r.Context(), "flash", "Passkey registered")
+
+	app.writeJSON(w, r, http.StatusOK, map[string]string{"redirect": "/user/passkeys"})
+}
+
+func (app *application) passkeyDeletePost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(r.PostForm.Get("id"))
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.credential.Delete(app.authenticatedUserID(r), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, app.authenticatedUser(r), "user.passkey_delete", fmt.Sprintf("user:%d", app.authenticatedUserID(r)), map[string]any{"credential": base64url(id)})
+
+	app.sessionManager.Put(r.Context(), "flash", "Passkey removed")
+
+	http.Redirect(w, r, "/user/passkeys", http.StatusSeeOther)
+}
+
+// passkeyLoginBeginPost start a passwordless login. The credential is not
+// known yet: the browser let the user pick one of their passkeys
+// (discoverable credentials). Browsers without WebAuthn support keep using the
+// password form handled by userLoginPost.
+func (app *application) passkeyLoginBeginPost(w http.ResponseWriter, r *http.Request) {
+	assertion, session, err := app.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.putWebauthnSession(r, "webauthnLogin", session)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, assertion)
+}
+
+func (app *application) passkeyLoginFinishPost(w http.ResponseWriter, r *http.Request) {
+	session, err := app.popWebauthnSession(r, "webauthnLogin")
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	credential, err := app.webauthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		return app.discoverableUser(r.Context(), rawID, userHandle)
+	}, *session, r)
+	if err != nil {
+		app.writeJSON(w, r, http.StatusUnauthorized, map[string]string{"error": "This passkey is not valid"})
+		return
+	}
+
+	stored, err := app.credential.Get(credential.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// keep the new sign counter so a cloned authenticator can be detected,
+	// and the clone warning so the passkey stays refused once it was raised
+	data, err := json.Marshal(credential)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.credential.Used(credential.ID, data)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// The sign counter went backwards: two authenticators share the key.
+	if credential.Authenticator.CloneWarning {
+		app.audit(r, nil, "user.passkey_clone_warning", fmt.Sprintf("user:%d", stored.UserID), map[string]any{"credential": base64url(credential.ID)})
+		app.writeJSON(w, r, http.StatusUnauthorized, map[string]string{"error": "This passkey may have been copied and can no longer be used. Log in with your password and register it again."})
+		return
+	}
+
+	// A passkey is already two factors (the device and its PIN or biometric
+	// check) so it doesn't go through the TOTP step.
+	err = app.logIn(r, stored.UserID, "passkey")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]string{"redirect": "/snippet/create"})
+}
+
+// ssoLogin start the OpenID Connect authorization code flow. The state, nonce
+// and PKCE verifier are kept in the session to check the provider answer.
+func (app *application) ssoLogin(w http.ResponseWriter, r *http.Request) {
+	if app.sso == nil {
+		app.notFound(w)
+		return
+	}
+
+	state, err := randomString()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	nonce, err := randomString()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	app.sessionManager.Put(r.Context(), "ssoState", state)
+	app.sessionManager.Put(r.Context(), "ssoNonce", nonce)
+	app.sessionManager.Put(r.Context(), "ssoVerifier", verifier)
+
+	authURL := app.sso.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (app *application) ssoCallback(w http.ResponseWriter, r *http.Request) {
+	if app.sso == nil {
+		app.notFound(w)
+		return
+	}
+
+	state := app.sessionManager.PopString(r.Context(), "ssoState")
+	nonce := app.sessionManager.PopString(r.Context(), "ssoNonce")
+	verifier := app.sessionManager.PopString(r.Context(), "ssoVerifier")
+
+	query := r.URL.Query()
+
+	if state == "" || !hmac.Equal([]byte(query.Get("state")), []byte(state)) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// e.g. the user refused to share their identity with us
+	if query.Get("error") != "" {
+		app.sessionManager.Put(r.Context(), "flash", "The single sign-on was cancelled.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	subject, claims, err := app.sso.exchange(r.Context(), query.Get("code"), verifier, nonce)
+	if err != nil {
+		app.requestLogger(r).Error(err.Error())
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Accounts are linked by email, an unverified email could take over the
+	// account of someone else.
+	name, ok := app.sso.account(claims)
+	if !ok {
+		app.sessionManager.Put(r.Context(), "flash", "Your account isn't allowed to login here.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := app.user.FromOIDC(r.Context(), subject, claims.Email, name)
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateEmail) {
+			app.sessionManager.Put(r.Context(), "flash", "This email is already linked to another single sign-on account.")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		} else if errors.Is(err, models.ErrUnverifiedEmail) {
+			app.sessionManager.Put(r.Context(), "flash", "An account with this email exists but the address was never verified. Log in with its password, or reset it, and verify the address before using single sign-on.")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.user.Get(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if user.Disabled {
+		app.sessionManager.Put(r.Context(), "flash", "This account has been disabled.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	// The identity provider is in charge of the second factor, the TOTP step
+	// is skipped like for passkeys.
+	err = app.logIn(r, id, "sso")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/snippet/create", http.StatusSeeOther)
+}
+
+func (app *application) accountView(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.Form = accountForm{Name: user.Name, Email: user.Email}
+	app.render(w, r, http.StatusOK, "account.html", data)
+}
+
+// accountUpdatePost change the name and email of the user. The current
+// password is only asked for a new email since it let the new address owner
+// reset the password.
+func (app *application) accountUpdatePost(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	var form accountForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	emailChanged := form.Email != user.Email
+
+	form.CheckField(validator.StringNotEmpty(form.Name), "name", "This field cannot be blank")
+	form.CheckField(validator.StringInLimit(form.Name, 255), "name", "This field cannot be more than 255 characters long")
+	form.CheckField(validator.StringNotEmpty(form.Email), "email", "This field cannot be blank")
+	form.CheckField(validator.ValidEmail(form.Email), "email", "This field must be a valid email address")
+	if emailChanged {
+		form.CheckField(validator.StringNotEmpty(form.CurrentPassword), "current_password", "Enter your current password to change your email")
+	}
+
+	if form.Valid() && emailChanged {
+		_, err = app.user.Authenticate(r.Context(), user.Email, form.CurrentPassword)
+		if err != nil {
+			if !errors.Is(err, models.ErrInvalidCredentials) {
+				app.serverError(w, r, err)
+				return
+			}
+			form.AddFieldError("current_password", "This password is incorrect")
+		}
+	}
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.User = user
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "account.html", data)
+		return
+	}
+
+	if form.Name != user.Name {
+		err = app.user.UpdateName(r.Context(), user.ID, form.Name)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	if emailChanged {
+		err = app.user.UpdateEmail(r.Context(), user.ID, form.Email)
+		if err != nil {
+			if errors.Is(err, models.ErrDuplicateEmail) {
+				form.AddFieldError("email", "Email already exist")
+
+				data := app.newTemplateData(r)
+				data.User = user
+				data.Form = form
+				app.render(w, r, http.StatusUnprocessableEntity, "account.html", data)
+			} else {
+				app.serverError(w, r, err)
+			}
+			return
+		}
+
+		app.audit(r, user, "user.email_change", fmt.Sprintf("user:%d", user.ID), map[string]any{"from": user.Email, "to": form.Email})
+
+		_, err = app.sendVerificationMail(r, &models.Users{ID: user.ID, Name: form.Name, Email: form.Email})
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		// reset links sent to the old address must not work anymore
+		err = app.token.DeleteAllForUser(user.ID, models.ScopePasswordReset)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Your account has been updated. Check %s to verify your new address.", form.Email))
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", "Your account has been updated.")
+	}
+
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
+
+func (app *application) passwordUpdate(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = passwordUpdateForm{}
+	app.render(w, r, http.StatusOK, "password_update.html", data)
+}
+
+func (app *application) passwordUpdatePost(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	var form passwordUpdateForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.StringNotEmpty(form.CurrentPassword), "current_password", "This field cannot be blank")
+	// Same rules as signup.
+	form.CheckField(validator.StringNotEmpty(form.NewPassword), "new_password", "This field cannot be blank")
+	form.CheckField(validator.MinChars(form.NewPassword, 8), "new_password", "This field must be at least 8 characters long")
+	form.CheckField(form.NewPassword == form.NewPasswordConfirmation, "new_password_confirmation", "Passwords do not match")
+
+	if form.Valid() {
+		_, err = app.user.Authenticate(r.Context(), user.Email, form.CurrentPassword)
+		if err != nil {
+			if !errors.Is(err, models.ErrInvalidCredentials) {
+				app.serverError(w, r, err)
+				return
+			}
+			form.AddFieldError("current_password", "This password is incorrect")
+		}
+	}
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "password_update.html", data)
+		return
+	}
+
+	err = app.user.UpdatePassword(r.Context(), user.ID, form.NewPassword)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.token.DeleteAllForUser(user.ID, models.ScopePasswordReset)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.signOutSessions(r, user.ID, false)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, user, "user.password_change", fmt.Sprintf("user:%d", user.ID), nil)
+
+	app.sessionManager.Put(r.Context(), "flash", "Your password has been changed. You've been logged out of your other sessions.")
+
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
+
+func (app *application) accountSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.userSession.ByUser(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Sessions = sessions
+	data.CurrentToken = app.sessionManager.Token(r.Context())
+	app.render(w, r, http.StatusOK, "sessions.html", data)
+}
+
+func (app *application) revokeSessionPost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PostForm.Get("id"))
+	if err != nil || id < 1 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	token, err := app.userSession.Delete(id, app.authenticatedUserID(r))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	err = app.sessionManager.Store.Delete(token)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, app.authenticatedUser(r), "user.session_revoke", fmt.Sprintf("user:%d", app.authenticatedUserID(r)), map[string]any{"session": id})
+
+	// revoking the current session is the same as logging out
+	if token == app.sessionManager.Token(r.Context()) {
+		app.signedOut(w, r, "You've been logged out successfully!")
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "The session has been signed out.")
+
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
+// revokeAllSessionsPost sign the user out everywhere, this device included.
+func (app *application) revokeAllSessionsPost(w http.ResponseWriter, r *http.Request) {
+	err := app.signOutSessions(r, app.authenticatedUserID(r), true)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, app.authenticatedUser(r), "user.session_revoke_all", fmt.Sprintf("user:%d", app.authenticatedUserID(r)), nil)
+
+	app.signedOut(w, r, "You've been signed out of all your sessions.")
+}
+
+// signedOut start a fresh anonymous session once the current one has been
+// signed out and send the user to the login page.
+func (app *application) signedOut(w http.ResponseWriter, r *http.Request, flash string) {
+	err := app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+	app.sessionManager.Put(r.Context(), "flash", flash)
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// deleteSnippetPost remove a snippet, for its author or a moderator cleaning
+// up content.
+func (app *application) deleteSnippetPost(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	snippet, err := app.snippet.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	if !app.canDeleteSnippet(r, snippet) {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	err = app.snippet.Delete(r.Context(), snippet.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, app.authenticatedUser(r), "snippet.delete", fmt.Sprintf("snippet:%d", snippet.ID), map[string]any{"title": snippet.Title})
+
+	app.sessionManager.Put(r.Context(), "flash", "Snippet deleted.")
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) adminDashboard(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.stats.Get()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Stats = stats
+	data.DBStats = app.stats.Pool()
+	app.render(w, r, http.StatusOK, "admin.html", data)
+}
+
+// adminPage returns the page number requested in the URL.
+func adminPage(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return page
+}
+
+func (app *application) adminUsers(w http.ResponseWriter, r *http.Request) {
+	page := adminPage(r)
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	users, total, err := app.user.Search(r.Context(), search, adminPageSize, (page-1)*adminPageSize)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.AdminUsers = users
+	data.Pagination = newPagination("/admin/users", r.URL.Query(), page, total)
+	app.render(w, r, http.StatusOK, "admin_users.html", data)
+}
+
+func (app *application) adminUserDisablePost(w http.ResponseWriter, r *http.Request) {
+	app.adminSetUserDisabled(w, r, true)
+}
+
+func (app *application) adminUserEnablePost(w http.ResponseWriter, r *http.Request) {
+	app.adminSetUserDisabled(w, r, false)
+}
+
+func (app *application) adminSetUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	// an admin locking themselves out would need the database to recover
+	if id == app.authenticatedUserID(r) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.user.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	err = app.user.SetDisabled(r.Context(), user.ID, disabled)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	action := "admin.user_enable"
+	if disabled {
+		action = "admin.user_disable"
+	}
+	app.audit(r, app.authenticatedUser(r), action, fmt.Sprintf("user:%d", user.ID), map[string]any{"email": user.Email})
+
+	if disabled {
+		err = app.signOutSessions(r, user.ID, true)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s has been disabled.", user.Email))
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s has been enabled.", user.Email))
+	}
+
+	app.adminRedirect(w, r, "/admin/users")
+}
+
+func (app *application) adminSnippets(w http.ResponseWriter, r *http.Request) {
+	page := adminPage(r)
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	snippets, total, err := app.snippet.Search(r.Context(), search, adminPageSize, (page-1)*adminPageSize)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Snippets = snippets
+	data.Pagination = newPagination("/admin/snippets", r.URL.Query(), page, total)
+	app.render(w, r, http.StatusOK, "admin_snippets.html", data)
+}
+
+func (app *application) adminSnippetExpirePost(w http.ResponseWriter, r *http.Request) {
+	app.adminSnippetAction(w, r, app.snippet.Expire, "admin.snippet_expire", "Snippet #%d has been expired.")
+}
+
+func (app *application) adminSnippetDeletePost(w http.ResponseWriter, r *http.Request) {
+	app.adminSnippetAction(w, r, app.snippet.Delete, "admin.snippet_delete", "Snippet #%d has been deleted.")
+}
+
+func (app *application) adminSnippetAction(w http.ResponseWriter, r *http.Request, action func(context.Context, int) error, event, flash string) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	err = action(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, app.authenticatedUser(r), event, fmt.Sprintf("snippet:%d", id), nil)
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf(flash, id))
+
+	app.adminRedirect(w, r, "/admin/snippets")
+}
+
+// adminRedirect send the admin back to the page of the table they came from,
+// given by the "return" form field when it is a page of that table.
+func (app *application) adminRedirect(w http.ResponseWriter, r *http.Request, table string) {
+	target := r.PostFormValue("return")
+	if target != table && !strings.HasPrefix(target, table+"?") {
+		target = table
+	}
+
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// reportedSnippet load the snippet named in the URL for the report pages.
+// When it doesn't exist, a response has already been sent and the caller
+// should simply return.
+func (app *application) reportedSnippet(w http.ResponseWriter, r *http.Request) *models.Snippet {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return nil
+	}
+
+	snippet, err := app.snippet.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return nil
+	}
+
+	return snippet
+}
+
+func (app *application) reportSnippet(w http.ResponseWriter, r *http.Request) {
+	snippet := app.reportedSnippet(w, r)
+	if snippet == nil {
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Snippet = snippet
+	data.Form = reportForm{}
+	app.render(w, r, http.StatusOK, "report.html", data)
+}
+
+func (app *application) reportSnippetPost(w http.ResponseWriter, r *http.Request) {
+	snippet := app.reportedSnippet(w, r)
+	if snippet == nil {
+		return
+	}
+
+	var form reportForm
+
+	err := app.decodeFormData(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.StringNotEmpty(form.Reason), "reason", "This field cannot be blank")
+	form.CheckField(validator.StringInLimit(form.Reason, 500), "reason", "This field cannot be more than 500 characters long")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Snippet = snippet
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "report.html", data)
+		return
+	}
+
+	reporters, err := app.report.Insert(snippet.ID, app.authenticatedUserID(r), form.Reason)
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateReport) {
+			app.sessionManager.Put(r.Context(), "flash", "You already reported this snippet, a moderator will review it.")
+			http.Redirect(w, r, fmt.Sprintf("/snippet/view/%d", snippet.ID), http.StatusSeeOther)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, app.authenticatedUser(r), "snippet.report", fmt.Sprintf("snippet:%d", snippet.ID), map[string]any{"reason": form.Reason})
+
+	// Enough people agree the snippet is abusive to hide it until a
+	// moderator has a look.
+	if app.reportThreshold > 0 && reporters >= app.reportThreshold {
+		err = app.snippet.SetHidden(r.Context(), snippet.ID, true)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		app.audit(r, nil, "snippet.auto_hide", fmt.Sprintf("snippet:%d", snippet.ID), map[string]any{"reporters": reporters})
+
+		app.sessionManager.Put(r.Context(), "flash", "Thanks for your report. The snippet is hidden until a moderator review it.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Thanks for your report, a moderator will review it.")
+
+	http.Redirect(w, r, fmt.Sprintf("/snippet/view/%d", snippet.ID), http.StatusSeeOther)
+}
+
+func (app *application) moderationQueue(w http.ResponseWriter, r *http.Request) {
+	queue, err := app.report.Queue()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Reported = queue
+	app.render(w, r, http.StatusOK, "moderation.html", data)
+}
+
+func (app *application) moderationDismissPost(w http.ResponseWriter, r *http.Request) {
+	app.moderate(w, r, models.ReportDismissed)
+}
+
+func (app *application) moderationHidePost(w http.ResponseWriter, r *http.Request) {
+	app.moderate(w, r, models.ReportHidden)
+}
+
+func (app *application) moderationDeletePost(w http.ResponseWriter, r *http.Request) {
+	app.moderate(w, r, models.ReportDeleted)
+}
+
+// moderate close the open reports of the snippet named in the URL with the
+// decision and apply it to the snippet. Dismissing the reports shows a snippet
+// hidden by the reports again.
+func (app *application) moderate(w http.ResponseWriter, r *http.Request, decision string) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	err = app.report.Resolve(id, app.authenticatedUserID(r), decision)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	switch decision {
+	case models.ReportDismissed:
+		err = app.snippet.SetHidden(r.Context(), id, false)
+	case models.ReportHidden:
+		err = app.snippet.SetHidden(r.Context(), id, true)
+	case models.ReportDeleted:
+		err = app.snippet.Delete(r.Context(), id)
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, app.authenticatedUser(r), "moderation."+decision, fmt.Sprintf("snippet:%d", id), nil)
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Reports on snippet #%d resolved: %s.", id, decision))
+
+	http.Redirect(w, r, "/moderation", http.StatusSeeOther)
+}
+
+// auditFilter read the filters of the audit log from the URL. The dates are
+// days, To is included.
+func auditFilter(r *http.Request) models.AuditFilter {
+	query := r.URL.Query()
+
+	filter := models.AuditFilter{
+		Action: strings.TrimSpace(query.Get("action")),
+		Actor:  strings.TrimSpace(query.Get("actor")),
+		Target: strings.TrimSpace(query.Get("target")),
+	}
+
+	if from, err := time.Parse("2006-01-02", query.Get("from")); err == nil {
+		filter.From = from
+	}
+	if to, err := time.Parse("2006-01-02", query.Get("to")); err == nil {
+		filter.To = to.AddDate(0, 0, 1)
+	}
+
+	return filter
+}
+
+func (app *application) adminAudit(w http.ResponseWriter, r *http.Request) {
+	page := adminPage(r)
+
+	events, total, err := app.auditLog.List(auditFilter(r), adminPageSize, (page-1)*adminPageSize)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.AuditEvents = events
+	data.Pagination = newPagination("/admin/audit", r.URL.Query(), page, total)
+	app.render(w, r, http.StatusOK, "admin_audit.html", data)
+}
+
+// adminAuditExport download the events matching the filters as CSV.
+func (app *application) adminAuditExport(w http.ResponseWriter, r *http.Request) {
+	filter := auditFilter(r)
+
+	app.audit(r, app.authenticatedUser(r), "admin.audit_export", "", map[string]any{"filters": r.URL.RawQuery})
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "created", "actor_id", "actor_email", "action", "ip", "user_agent", "target", "details"})
+
+	// The response has started, an error can only be logged. The file is then
+	// truncated.
+	err := app.auditLog.Each(filter, func(e *models.AuditEvent) error {
+		return out.Write([]string{
+			strconv.FormatInt(e.ID, 10),
+			e.Created.Format("2006-01-02 15:04:05"),
+			strconv.Itoa(e.ActorID),
+			csvSafe(e.ActorEmail),
+			e.Action,
+			e.IP,
+			csvSafe(e.UserAgent),
+			csvSafe(e.Target),
+			csvSafe(string(e.Details)),
+		})
+	})
+	if err != nil {
+		app.requestLogger(r).Error(err.Error())
+	}
+
+	out.Flush()
+}
+
+// healthz tells the process is alive and serving requests.
+func (app *application) healthz(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz tells whether the instance can take traffic: the database answers,
+// the templates are loaded and the server isn't shutting down.
+func (app *application) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"database":  "ok",
+		"templates": "ok",
+		"shutdown":  "ok",
+	}
+	ready := true
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	err := app.db.PingContext(ctx)
+	if err != nil {
+		// the error may tell more about the database than we want to share
+		app.requestLogger(r).Error(err.Error(), "check", "database")
+		checks["database"] = "unavailable"
+		ready = false
+	}
+
+	if len(app.templateCache) == 0 {
+		checks["templates"] = "not loaded"
+		ready = false
+	}
+
+	if app.shuttingDown.Load() {
+		checks["shutdown"] = "shutting down"
+		ready = false
+	}
+
+	if !ready {
+		app.writeJSON(w, r, http.StatusServiceUnavailable, map[string]any{"status": "unavailable", "checks": checks})
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]any{"status": "ok", "checks": checks})
+}
+
+// version returns what is running, from the build information embedded by
+// the Go toolchain.
+func (app *application) version(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]string{
+		"build_time": buildTime,
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		resp["version"] = info.Main.Version
+		resp["go_version"] = info.GoVersion
+
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				resp["revision"] = setting.Value
+			case "vcs.time":
+				resp["revision_time"] = setting.Value
+			case "vcs.modified":
+				resp["modified"] = setting.Value
+			}
+		}
+	}
+
+	app.writeJSON(w, r, http.StatusOK, resp)
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestOembedHost check the oEmbed endpoint only answers for the configured
+// site, whatever the Host header says. The snippet of a foreign URL is never
+// looked up, so the application needs no database here.
+func TestOembedHost(t *testing.T) {
+	app := &application{baseURL: "https://snippetbox.example.com"}
+
+	for _, target := range []string{
+		"https://attacker.example/snippet/view/1",
+		"javascript://snippetbox.example.com/snippet/view/1",
+		"https://snippetbox.example.com.attacker.example/snippet/view/1",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/oembed?url="+url.QueryEscape(target), nil)
+		r.Host = "attacker.example"
+
+		rr := httptest.NewRecorder()
+		app.oembed(rr, r)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("oembed for %s answered %d, want 404", target, rr.Code)
+		}
+	}
+}
@@ -2,22 +2,72 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/go-playground/form/v4"
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel/trace"
+	"snippetbox.kamanazan.net/internal/mailer"
+	"snippetbox.kamanazan.net/internal/models"
 )
 
-func (app *application) serverError(w http.ResponseWriter, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	app.errorLog.Print(trace)
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	app.requestLogger(r).Error(err.Error(), "method", r.Method, "uri", r.URL.RequestURI(), "stack", string(debug.Stack()))
 
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
+// requestLogger returns the logger with the ID of the request attached, so
+// every line logged about the request can be found from the ID. The trace ID
+// is attached too when the request is traced.
+func (app *application) requestLogger(r *http.Request) *slog.Logger {
+	logger := app.logger
+
+	if id, ok := r.Context().Value(requestIDContextKey).(string); ok {
+		logger = logger.With("request_id", id)
+	}
+
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsSampled() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+
+	return logger
+}
+
+var requestIDRx = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func validRequestID(id string) bool {
+	return requestIDRx.MatchString(id)
+}
+
+// newRequestID returns a random ID, 16 bytes hex encoded.
+func newRequestID() string {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		// crypto/rand doesn't fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(random)
+}
+
 func (app *application) clientError(w http.ResponseWriter, status int) {
 	http.Error(w, http.StatusText(status), status)
 }
@@ -26,7 +76,7 @@ func (app *application) notFound(w http.ResponseWriter) {
 	app.clientError(w, http.StatusNotFound)
 }
 
-func (app *application) render(w http.ResponseWriter, status int, page string, data *templateData) {
+func (app *application) render(w http.ResponseWriter, r *http.Request, status int, page string, data *templateData) {
 	// Retrieve the appropriate template set from the cache based on the page
 	// name (like 'home.tmpl'). If no entry exists in the cache with the
 	// provided name, then create a new error and call the serverError() helper
@@ -34,7 +84,7 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
 	ts, ok := app.templateCache[page]
 	if !ok {
 		err := fmt.Errorf("the template %s does not exist", page)
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -44,9 +94,13 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
 	// is any error we call the the serverError() helper.
 	// we wrote the response to buffer instead of httpResonseWriter to handle error in the template
 	// this prevent client seeing half rendered page with error
+	_, span := tracer.Start(r.Context(), "render "+page)
+	start := time.Now()
 	err := ts.ExecuteTemplate(buf, "base", data)
+	app.metrics.renderDuration.WithLabelValues(page).Observe(time.Since(start).Seconds())
+	span.End()
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -58,9 +112,28 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
 	buf.WriteTo(w)
 }
 
-func (app *application) newTemplateData() *templateData {
+// writeJSON encode data as the JSON body of the response.
+func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, data any) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+func (app *application) newTemplateData(r *http.Request) *templateData {
 	return &templateData{
-		CurrentYear: time.Now().Year(),
+		CurrentYear:     time.Now().Year(),
+		FlashMsg:        app.sessionManager.PopString(r.Context(), "flash"),
+		IsAuthenticated: app.isAuthenticated(r),
+		IsVerified:      app.authenticatedUser(r) != nil && app.authenticatedUser(r).Verified,
+		SSOEnabled:      app.sso != nil,
+		IsAdmin:         app.authenticatedUser(r) != nil && app.authenticatedUser(r).HasRole(models.RoleAdmin),
+		IsModerator:     app.authenticatedUser(r) != nil && app.authenticatedUser(r).HasRole(models.RoleModerator),
 	}
 }
 
@@ -82,3 +155,328 @@ func (app *application) decodeFormData(r *http.Request, dst any) error {
 	}
 	return nil
 }
+
+// isAuthenticated reports whether the request comes from a logged in user, the
+// value is set in the request context by the authenticate middleware.
+func (app *application) isAuthenticated(r *http.Request) bool {
+	isAuthenticated, ok := r.Context().Value(isAuthenticatedContextKey).(bool)
+	if !ok {
+		return false
+	}
+	return isAuthenticated
+}
+
+// authenticatedUser returns the logged in user as loaded by the authenticate
+// middleware, or nil when nobody is logged in.
+func (app *application) authenticatedUser(r *http.Request) *models.Users {
+	user, ok := r.Context().Value(userContextKey).(*models.Users)
+	if !ok {
+		return nil
+	}
+	return user
+}
+
+// authenticatedUserID returns the ID of the logged in user, or 0 when nobody
+// is logged in.
+func (app *application) authenticatedUserID(r *http.Request) int {
+	user := app.authenticatedUser(r)
+	if user == nil {
+		return 0
+	}
+	return user.ID
+}
+
+// logIn authenticate the session as the user and record it in the user's
+// active sessions. method tell how the user proved who they are, for the
+// audit log.
+func (app *application) logIn(r *http.Request, id int, method string) error {
+	user, err := app.user.Get(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	// Change the session ID whenever the authentication state changes to
+	// prevent session fixation attacks.
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		return err
+	}
+
+	err = app.userSession.Insert(app.sessionManager.Token(r.Context()), id, clientIP(r), r.UserAgent())
+	if err != nil {
+		return err
+	}
+
+	app.sessionManager.Put(r.Context(), "authenticatedUserID", id)
+
+	app.audit(r, user, "user.login", fmt.Sprintf("user:%d", id), map[string]any{"method": method})
+
+	return nil
+}
+
+// signOutSessions end the sessions of the user on every other device, or on
+// every device including this one when all is true.
+func (app *application) signOutSessions(r *http.Request, userID int, all bool) error {
+	keep := app.sessionManager.Token(r.Context())
+	if all {
+		keep = ""
+	}
+
+	tokens, err := app.userSession.DeleteAllForUser(userID, keep)
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		err := app.sessionManager.Store.Delete(token)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// canDeleteSnippet returns whether the logged in user is the author of the
+// snippet or a moderator.
+func (app *application) canDeleteSnippet(r *http.Request, snippet *models.Snippet) bool {
+	user := app.authenticatedUser(r)
+	if user == nil {
+		return false
+	}
+
+	return (snippet.UserID != 0 && snippet.UserID == user.ID) || user.HasRole(models.RoleModerator)
+}
+
+// csvSafe prevent spreadsheets from running a user controlled value of a CSV
+// export as a formula.
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// ownedCollection load the collection named in the URL and make sure it
+// belongs to the logged in user. When it doesn't, a response has already been
+// sent and the caller should simply return.
+func (app *application) ownedCollection(w http.ResponseWriter, r *http.Request) (*models.Collection, bool) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, ok := collectionID(params.ByName("ref"))
+	if !ok {
+		app.notFound(w)
+		return nil, false
+	}
+
+	collection, err := app.collection.Get(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return nil, false
+	}
+
+	if collection.UserID != app.authenticatedUserID(r) {
+		app.notFound(w)
+		return nil, false
+	}
+
+	return collection, true
+}
+
+// collectionID returns the ID at the start of a collection reference as made
+// by Collection.Ref, the slug after it is ignored.
+func collectionID(ref string) (int, bool) {
+	prefix, _, _ := strings.Cut(ref, "-")
+
+	id, err := strconv.Atoi(prefix)
+	if err != nil || id < 1 {
+		return 0, false
+	}
+	return id, true
+}
+
+// slugify turn a collection name into the lowercase, dash separated form used
+// in its URL, e.g. "Start Here!" become "start-here".
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+
+	for _, c := range strings.ToLower(name) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if dash && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+
+	return b.String()
+}
+
+// clientIP returns the IP address of the client, as resolved by the realIP
+// middleware, without the port.
+func clientIP(r *http.Request) string {
+	ip, ok := r.Context().Value(clientIPContextKey).(string)
+	if !ok {
+		return remoteIP(r)
+	}
+	return ip
+}
+
+// remoteIP returns the IP address of the peer of the connection, a proxy when
+// there is one.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedClientIP returns the IP of the client. Behind a trusted proxy it is
+// the last address of X-Forwarded-For which isn't one of our proxies, anything
+// before it can be forged by the client.
+func forwardedClientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip := remoteIP(r)
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parse a comma separated list of IPs and CIDR networks.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// parseBaseURL check the -base-url flag and returns it without trailing
+// slash, e.g. https://snippetbox.example.com.
+func parseBaseURL(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("base-url is required, e.g. https://snippetbox.example.com")
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("base-url must be a scheme and a host, e.g. https://snippetbox.example.com, not %q", s)
+	}
+
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// background run fn in a new goroutine, recovering from any panic so it can't
+// crash the whole server.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error(fmt.Sprint(err), "stack", string(debug.Stack()))
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// verificationSignature sign the user ID, email and expiry of a verification
+// link. The email is part of the signature so a link stop working once the
+// address is changed.
+func (app *application) verificationSignature(userID int, email string, expires int64) string {
+	mac := hmac.New(sha256.New, app.secret)
+	fmt.Fprintf(mac, "verify|%d|%s|%d", userID, email, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sendVerificationMail email the user a signed link to verify their address,
+// valid for 24 hours. It returns false when a mail was already sent recently.
+func (app *application) sendVerificationMail(r *http.Request, user *models.Users) (bool, error) {
+	allowed, err := app.user.AllowVerificationMail(r.Context(), user.ID, 5*time.Minute)
+	if err != nil || !allowed {
+		return false, err
+	}
+
+	expires := time.Now().Add(24 * time.Hour).Unix()
+
+	query := url.Values{}
+	query.Set("id", strconv.Itoa(user.ID))
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", app.verificationSignature(user.ID, user.Email, expires))
+
+	link := fmt.Sprintf("%s/user/verify?%s", app.baseURL, query.Encode())
+
+	app.background(func() {
+		err := app.mailer.Send(mailer.Message{
+			To:      user.Email,
+			Subject: "Verify your Snippetbox email address",
+			Body: fmt.Sprintf("Hi %s,\n\nPlease confirm this is your email address by following the link below "+
+				"within the next 24 hours:\n\n%s\n", user.Name, link),
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	return true, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseBaseURL(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "https://snippetbox.example.com", want: "https://snippetbox.example.com"},
+		{in: "https://snippetbox.example.com/", want: "https://snippetbox.example.com"},
+		{in: "http://localhost:4000", want: "http://localhost:4000"},
+		{in: "", wantErr: true},
+		{in: "snippetbox.example.com", wantErr: true},
+		{in: "ftp://snippetbox.example.com", wantErr: true},
+		{in: "https://", wantErr: true},
+		{in: "https://snippetbox.example.com/app", wantErr: true},
+		{in: "https://snippetbox.example.com/?a=b", wantErr: true},
+		{in: "https://user@snippetbox.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseBaseURL(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseBaseURL(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseBaseURL(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -1,30 +1,91 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
 	"html/template"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alexedwards/scs/postgresstore" // New import
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-playground/form/v4"
+	"github.com/go-webauthn/webauthn/webauthn"
 	_ "github.com/lib/pq" // we alias this import to blank identifier because we only need its init() function so it is registered in database/sql
 
+	"snippetbox.kamanazan.net/internal/mailer"
 	"snippetbox.kamanazan.net/internal/models"
+	"snippetbox.kamanazan.net/internal/validator"
 )
 
+// buildTime is set at build time with
+// -ldflags "-X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)".
+var buildTime string
+
 type application struct {
-	errorLog       *log.Logger
-	infoLog        *log.Logger
+	logger         *slog.Logger
+	db             *sql.DB
 	snippet        *models.SnippetModel
 	user           *models.UsersModel
+	star           *models.StarModel
+	collection     *models.CollectionModel
+	view           *models.ViewModel
+	viewRecorder   *viewRecorder
 	templateCache  map[string]*template.Template
 	formDecoder    *form.Decoder
 	sessionManager *scs.SessionManager
+	embedAncestors string
+	token          *models.TokenModel
+	mailer         mailer.Mailer
+	secret         []byte
+	// scheme and host of the site, e.g. https://snippetbox.example.com, the
+	// absolute links of mails, feeds and oEmbed are built from it and never
+	// from the request
+	baseURL      string
+	recoveryCode *models.RecoveryCodeModel
+	// AES-256 key protecting the TOTP secrets, 2FA can't be enrolled without it
+	encryptionKey []byte
+	credential    *models.CredentialModel
+	userSession   *models.UserSessionModel
+	loginThrottle *models.LoginThrottleModel
+	stats         *models.StatsModel
+	report        *models.ReportModel
+	auditLog      *models.AuditModel
+	quota         *models.QuotaModel
+	contentPolicy contentPolicy
+	snippetQuota  snippetQuota
+	limiter       *rateLimiter
+	// proxies allowed to tell the client IP with X-Forwarded-For
+	trustedProxies []*net.IPNet
+	metrics        *metrics
+	webauthn       *webauthn.WebAuthn
+	// nil when the SSO login isn't configured
+	sso *ssoProvider
+	// when set, only users with a verified email can create snippets
+	requireVerifiedEmail bool
+	// distinct reports hiding a snippet until moderation, 0 to never hide
+	reportThreshold int
+	// policy for snippets containing secrets, one of secretScanModes
+	secretScan string
+	// address of the separate /metrics listener, empty to serve the metrics
+	// to the admins of the application
+	metricsAddr string
+	// set when the server start shutting down, /readyz then fails
+	shuttingDown atomic.Bool
+	// wg track the goroutines started with app.background()
+	wg sync.WaitGroup
 }
 
 func openDB(dsn string) (*sql.DB, error) {
@@ -51,6 +112,42 @@ func main() {
 	// flag will be stored in the addr variable at runtime.
 	addr := flag.String("addr", ":4000", "Define adress:port")
 	dsn := flag.String("dsn", "postgresql://kamanazan@localhost/snippet?sslmode=disable", "provide database connection string")
+	embedAncestors := flag.String("embed-ancestors", "'self'", "space separated CSP frame-ancestors sources allowed to embed snippets, e.g. https://wiki.example.com")
+	smtpAddr := flag.String("smtp-addr", "", "SMTP server host:port, mails are written to the info log when empty")
+	smtpUsername := flag.String("smtp-username", "", "SMTP username")
+	smtpPassword := flag.String("smtp-password", "", "SMTP password")
+	smtpFrom := flag.String("smtp-from", "Snippetbox <no-reply@snippetbox.local>", "sender address of the mails")
+	secret := flag.String("secret", "", "secret key used to sign links sent by email, required")
+	baseURLFlag := flag.String("base-url", "", "scheme and host the site is reached at, e.g. https://snippetbox.example.com, used in the links sent by email, the feeds and oEmbed, required")
+	requireVerifiedEmail := flag.Bool("require-verified", true, "only allow users with a verified email to create snippets")
+	encryptionKey := flag.String("encryption-key", "", "hex encoded 32 bytes key encrypting 2FA secrets, 2FA enrollment is disabled when empty")
+	webauthnRPID := flag.String("webauthn-rpid", "localhost", "WebAuthn relying party ID, the domain of the site")
+	webauthnOrigins := flag.String("webauthn-origins", "https://localhost:4000", "comma separated origins allowed for passkeys")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL, the SSO login is disabled when empty")
+	oidcClientID := flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcClientSecret := flag.String("oidc-client-secret", "", "OpenID Connect client secret")
+	oidcRedirectURL := flag.String("oidc-redirect-url", "https://localhost:4000/user/login/sso/callback", "OpenID Connect redirect URL registered at the provider")
+	oidcAllowedDomains := flag.String("oidc-allowed-domains", "", "comma separated email domains allowed to login with SSO, any when empty")
+	reportThreshold := flag.Int("report-threshold", 3, "distinct user reports hiding a snippet until a moderator review it, 0 to never hide")
+	secretScan := flag.String("secret-scan", secretScanWarn, "what to do with snippets containing secrets: block, warn or redact")
+	spamQuarantine := flag.Float64("spam-quarantine", 5, "spam score holding a new snippet until a moderator review it, 0 to never quarantine")
+	spamReject := flag.Float64("spam-reject", 10, "spam score rejecting a new snippet, 0 to never reject")
+	spamBlockedDomains := flag.String("spam-blocked-domains", "", "comma separated domains, links to them or their subdomains count as spam")
+	spamBlockedKeywords := flag.String("spam-blocked-keywords", "", "comma separated keywords counting as spam")
+	snippetQuotaUser := flag.Int("snippet-quota-user", 30, "snippets a user can create per hour, 0 for no limit")
+	snippetQuotaIP := flag.Int("snippet-quota-ip", 60, "snippets a client IP can create per hour, 0 for no limit")
+	rateLimitRead := flag.Int("rate-limit-read", 300, "GET requests per minute per client, 0 for no limit")
+	rateLimitWrite := flag.Int("rate-limit-write", 60, "POST requests per minute per client, 0 for no limit")
+	rateLimitAuth := flag.Int("rate-limit-auth", 10, "login, signup and password reset attempts per minute per client, 0 for no limit")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated IPs or CIDR networks of the proxies allowed to set X-Forwarded-For")
+	metricsAddr := flag.String("metrics-addr", "", "address of a separate plain HTTP listener for /metrics, only served to admins of the application when empty")
+	otelExporter := flag.String("otel-exporter", "none", "where to send the traces: none, stdout or otlp")
+	otelEndpoint := flag.String("otel-endpoint", "http://localhost:4318", "URL of the OTLP over HTTP collector, for -otel-exporter otlp")
+	shutdownDelay := flag.Duration("shutdown-delay", 5*time.Second, "time between failing /readyz and closing the listener on SIGTERM, for the load balancer to notice")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 20*time.Second, "time left to the requests in flight and background tasks to finish on SIGTERM")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum level logged: debug, info, warn or error")
+	viewSalt := flag.String("view-salt", "", "secret used to hash visitor IPs for the view counter, random when empty")
 
 	// Importantly, we use the flag.Parse() function to parse the command-line flag.
 	// This reads in the command-line flag value and assigns it to the addr
@@ -60,13 +157,15 @@ func main() {
 	// User can list available params from the '-help' param
 	flag.Parse()
 
-	//Define logging with its various prefix
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	logger, err_logger := newLogger(os.Stdout, *logFormat, *logLevel)
+	if err_logger != nil {
+		fmt.Fprintln(os.Stderr, err_logger)
+		os.Exit(2)
+	}
 
 	db, err_db_connection := openDB(*dsn)
 	if err_db_connection != nil {
-		errorLog.Fatal(err_db_connection)
+		fatal(logger, err_db_connection)
 	}
 
 	defer db.Close()
@@ -76,28 +175,141 @@ func main() {
 
 	templateCache, err_template := newTemplateCache()
 	if err_template != nil {
-		errorLog.Fatal(err_template)
+		fatal(logger, err_template)
 	}
 
 	formDecoder := form.NewDecoder()
 
+	// Without a configured salt, generate one for the lifetime of the process.
+	// Visitors will then be counted again after a restart.
+	if *viewSalt == "" {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			fatal(logger, err)
+		}
+		*viewSalt = hex.EncodeToString(salt)
+	}
+
+	// The signing key can't be random, the links sent by email would break on
+	// restart and between instances.
+	if *secret == "" {
+		fatal(logger, "secret is required, e.g. generate one with: openssl rand -hex 32")
+	}
+
+	// The Host header is chosen by the client, a link built from it could
+	// send a reset token to another site.
+	siteURL, err_base := parseBaseURL(*baseURLFlag)
+	if err_base != nil {
+		fatal(logger, err_base)
+	}
+
+	// Unlike the other secrets this key can't be random, the TOTP secrets
+	// stored in the database would be lost on the next restart.
+	key, err_key := hex.DecodeString(*encryptionKey)
+	if err_key != nil || (len(key) != 0 && len(key) != 32) {
+		fatal(logger, "encryption-key must be 64 hexadecimal characters")
+	}
+	if len(key) == 0 {
+		key = nil
+	}
+
+	if !validator.PermittedValue(*secretScan, secretScanModes...) {
+		fatal(logger, "secret-scan must be one of "+strings.Join(secretScanModes, ", "))
+	}
+
+	proxies, err_proxies := parseTrustedProxies(*trustedProxies)
+	if err_proxies != nil {
+		fatal(logger, err_proxies)
+	}
+
+	tracerProvider, err_tracing := newTracerProvider(context.Background(), *otelExporter, *otelEndpoint, os.Stdout)
+	if err_tracing != nil {
+		fatal(logger, err_tracing)
+	}
+
+	webAuthn, err_webauthn := webauthn.New(&webauthn.Config{
+		RPID:          *webauthnRPID,
+		RPDisplayName: "Snippetbox",
+		RPOrigins:     strings.Split(*webauthnOrigins, ","),
+	})
+	if err_webauthn != nil {
+		fatal(logger, err_webauthn)
+	}
+
+	var sso *ssoProvider
+	if *oidcIssuer != "" {
+		var err_sso error
+		sso, err_sso = newSSOProvider(context.Background(), *oidcIssuer, *oidcClientID, *oidcClientSecret, *oidcRedirectURL, *oidcAllowedDomains)
+		if err_sso != nil {
+			fatal(logger, err_sso)
+		}
+	}
+
+	viewModel := &models.ViewModel{DB: db}
+
+	limiter := newRateLimiter(map[string]int{
+		rateRead:  *rateLimitRead,
+		rateWrite: *rateLimitWrite,
+		rateAuth:  *rateLimitAuth,
+	})
+
+	var mail mailer.Mailer = &mailer.LogMailer{Logger: logger}
+	if *smtpAddr != "" {
+		mail = &mailer.SMTPMailer{
+			Addr:     *smtpAddr,
+			Username: *smtpUsername,
+			Password: *smtpPassword,
+			From:     *smtpFrom,
+		}
+	}
+
 	app := &application{ // the struct serve as dependeny injection, we defined it here and pass it to the handler function
-		errorLog:       errorLog,
-		infoLog:        infoLog,
+		logger:         logger,
+		db:             db,
 		snippet:        &models.SnippetModel{DB: db},
 		user:           &models.UsersModel{DB: db},
+		star:           &models.StarModel{DB: db},
+		collection:     &models.CollectionModel{DB: db},
+		view:           viewModel,
+		viewRecorder:   newViewRecorder(viewModel, logger, *viewSalt, 1024),
 		templateCache:  templateCache,
 		formDecoder:    formDecoder,
 		sessionManager: sessionManager,
+		embedAncestors: *embedAncestors,
+		token:          &models.TokenModel{DB: db},
+		mailer:         mail,
+		secret:         []byte(*secret),
+		baseURL:        siteURL,
+		recoveryCode:   &models.RecoveryCodeModel{DB: db},
+		encryptionKey:  key,
+		credential:     &models.CredentialModel{DB: db},
+		userSession:    &models.UserSessionModel{DB: db},
+		loginThrottle:  &models.LoginThrottleModel{DB: db},
+		stats:          &models.StatsModel{DB: db},
+		report:         &models.ReportModel{DB: db},
+		auditLog:       &models.AuditModel{DB: db},
+		quota:          &models.QuotaModel{DB: db},
+		contentPolicy:  newContentPolicy(*spamQuarantine, *spamReject, *spamBlockedDomains, *spamBlockedKeywords),
+		snippetQuota:   snippetQuota{perUser: *snippetQuotaUser, perIP: *snippetQuotaIP},
+		limiter:        limiter,
+		trustedProxies: proxies,
+		metrics:        newMetrics(db),
+		webauthn:       webAuthn,
+		sso:            sso,
+
+		requireVerifiedEmail: *requireVerifiedEmail,
+		reportThreshold:      *reportThreshold,
+		secretScan:           *secretScan,
+		metricsAddr:          *metricsAddr,
 	}
 
 	// Initialize a new http.Server struct. We set the Addr and Handler fields so
 	// that the server uses the same network address and routes as before, and set
-	// the ErrorLog field so that the server now uses the custom errorLog logger in
-	// the event of any problems. (p.71)
+	// the ErrorLog field so that the server errors go through our structured
+	// logger too. (p.71)
 	srv := &http.Server{ // why use pointer ?
 		Addr:     *addr,
-		ErrorLog: errorLog,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
 		Handler:  app.routes(),
 		// Add Idle, Read and Write timeouts to the server.
 		IdleTimeout:  time.Minute,
@@ -105,12 +317,61 @@ func main() {
 		WriteTimeout: 10 * time.Second,
 	}
 
-	// The value returned from the flag.String() function is a pointer to the flag
-	// value, not the value itself. So we need to dereference the pointer (i.e.
-	// prefix it with the * symbol) before using it. Note that we're using the
-	// log.Printf() function to interpolate the address with the log message.
-	infoLog.Printf("Starting server on %s", *addr)
+	var metricsSrv *http.Server
+	if *metricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", app.metrics.handler())
+
+		metricsSrv = &http.Server{
+			Addr:        *metricsAddr,
+			ErrorLog:    srv.ErrorLog,
+			Handler:     metricsMux,
+			ReadTimeout: 5 * time.Second,
+		}
+	}
+
+	err := app.serve(srv, metricsSrv, *shutdownDelay, *shutdownTimeout)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal(logger, err)
+	}
+
+	// send the spans still buffered
+	if tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err = tracerProvider.Shutdown(ctx)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+
+	logger.Info("server stopped")
+}
+
+// newLogger returns a logger writing to w in the given format, text or json,
+// and ignoring the records under level.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
 
-	err := srv.ListenAndServeTLS("./tls/cert.pem", "./tls/key.pem")
-	errorLog.Fatal(err)
+// fatal log the error and exit, slog has no Fatal.
+func fatal(logger *slog.Logger, err any) {
+	logger.Error(fmt.Sprint(err))
+	os.Exit(1)
 }
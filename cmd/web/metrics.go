@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics hold the Prometheus metrics of the application, exposed on
+// /metrics.
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	inFlight        prometheus.Gauge
+	renderDuration  *prometheus.HistogramVec
+	snippetsCreated prometheus.Counter
+	panics          prometheus.Counter
+}
+
+func newMetrics(db *sql.DB) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "snippetbox_http_requests_total",
+			Help: "HTTP requests by route pattern, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "snippetbox_http_request_duration_seconds",
+			Help:    "Time to answer HTTP requests by route pattern and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "snippetbox_http_requests_in_flight",
+			Help: "HTTP requests being answered.",
+		}),
+		renderDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "snippetbox_template_render_duration_seconds",
+			Help:    "Time to render page templates.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1},
+		}, []string{"template"}),
+		snippetsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "snippetbox_snippets_created_total",
+			Help: "Snippets created.",
+		}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "snippetbox_panics_recovered_total",
+			Help: "Panics recovered while answering requests.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.inFlight,
+		m.renderDuration,
+		m.snippetsCreated,
+		m.panics,
+		collectors.NewDBStatsCollector(db, "snippetbox"),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// handler serve the metrics in the Prometheus exposition format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// routeContextKey hold a *string the router fills with the pattern of the
+// matched route, see instrumentedRouter.
+const routeContextKey = contextKey("route")
+
+// instrument count the requests and measure how long they take, labelled with
+// the route pattern rather than the path so /snippet/view/:id is a single
+// series.
+func (app *application) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		app.metrics.inFlight.Inc()
+		defer app.metrics.inFlight.Dec()
+
+		route := "unmatched"
+		ctx := context.WithValue(r.Context(), routeContextKey, &route)
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		method := metricMethod(r.Method)
+		app.metrics.requests.WithLabelValues(route, method, strconv.Itoa(rec.status)).Inc()
+		app.metrics.requestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricMethod returns the method label of a request. The method is chosen by
+// the client, any other than the standard ones would be a new series.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// instrumentedRouter is a httprouter.Router telling the instrument
+// middleware which route matched the request, httprouter doesn't keep the
+// pattern.
+type instrumentedRouter struct {
+	*httprouter.Router
+}
+
+func (ir *instrumentedRouter) Handler(method, path string, handler http.Handler) {
+	ir.Router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route, ok := r.Context().Value(routeContextKey).(*string); ok {
+			*route = path
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func (ir *instrumentedRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	ir.Handler(method, path, handler)
+}
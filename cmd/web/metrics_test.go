@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+func TestMetricMethod(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{http.MethodGet, "GET"},
+		{http.MethodPost, "POST"},
+		{http.MethodOptions, "OPTIONS"},
+		{"get", "other"},
+		{"PROPFIND", "other"},
+		{"X-RANDOM-12345", "other"},
+		{"", "other"},
+	}
+
+	for _, tt := range tests {
+		if got := metricMethod(tt.method); got != tt.want {
+			t.Errorf("metricMethod(%q) = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsRoute(t *testing.T) {
+	limiter := newRateLimiter(map[string]int{})
+	t.Cleanup(limiter.Close)
+
+	app := &application{
+		logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		sessionManager: scs.New(),
+		metrics:        newMetrics(nil),
+		limiter:        limiter,
+	}
+
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/login" {
+		t.Errorf("anonymous request to /metrics answered %d, want a redirect to the login", rr.Code)
+	}
+
+	// with a listener of their own the metrics aren't served by the
+	// application at all
+	app.metricsAddr = "localhost:9090"
+
+	rr = httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("/metrics answered %d with -metrics-addr, want 404", rr.Code)
+	}
+}
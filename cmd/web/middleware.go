@@ -1,14 +1,26 @@
 package main
 
 import (
+    "context"
+    "errors"
     "fmt"
     "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "snippetbox.kamanazan.net/internal/models"
 )
 
+// contentSecurityPolicy returns the CSP of every page, only the sources
+// allowed to frame the page change between routes.
+func contentSecurityPolicy(frameAncestors string) string {
+    return "default-src 'self'; style-src 'self' fonts.googleapis.com; font-src fonts.gstatic.com; frame-ancestors " + frameAncestors
+}
+
 func secureHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
-        w.Header().Set("Content-Security-Policy",
-            "default-src 'self'; style-src 'self' fonts.googleapis.com; font-src fonts.gstatic.com")
+        w.Header().Set("Content-Security-Policy", contentSecurityPolicy("'none'"))
         w.Header().Set("Referrer-Policy", "origin-when-cross-origin")
         w.Header().Set("X-Content-Type-Options", "nosniff")
         w.Header().Set("X-Frame-Options", "deny")
@@ -18,14 +30,87 @@ func secureHeaders(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) logRequest(next http.Handler) http.Handler {
+// allowFraming relax the anti-framing headers set by secureHeaders so the
+// route can be displayed in an iframe by the configured embed ancestors. It
+// must run after secureHeaders to override its values.
+func (app *application) allowFraming(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
-        app.infoLog.Printf("%s - %s %s %s", r.RemoteAddr, r.Proto, r.Method, r.URL.RequestURI())
-        
+        w.Header().Set("Content-Security-Policy", contentSecurityPolicy(app.embedAncestors))
+        w.Header().Del("X-Frame-Options")
+
         next.ServeHTTP(w, r)
     })
 }
 
+// realIP resolve the IP of the client once for the whole request, behind a
+// trusted proxy it comes from X-Forwarded-For. It must come first in the chain,
+// every use of clientIP is after it.
+func (app *application) realIP(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        ctx := context.WithValue(r.Context(), clientIPContextKey, forwardedClientIP(r, app.trustedProxies))
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// requestID give every request an ID, logged with everything about the
+// request and sent back in X-Request-ID. The ID set by a proxy in front of us
+// is kept so the logs of both can be matched.
+func (app *application) requestID(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID(id) {
+            id = newRequestID()
+        }
+
+        w.Header().Set("X-Request-ID", id)
+
+        ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// responseRecorder remember the status and size of the response for the logs.
+type responseRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+    rec.status = status
+    rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+    n, err := rec.ResponseWriter.Write(b)
+    rec.bytes += n
+    return n, err
+}
+
+// Unwrap let http.ResponseController reach the underlying ResponseWriter.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+    return rec.ResponseWriter
+}
+
+func (app *application) logRequest(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        start := time.Now()
+        rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+        next.ServeHTTP(rec, r)
+
+        app.requestLogger(r).Info("request",
+            "ip", clientIP(r),
+            "proto", r.Proto,
+            "method", r.Method,
+            "path", r.URL.Path,
+            "status", rec.status,
+            "bytes", rec.bytes,
+            "duration", time.Since(start),
+        )
+    })
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
@@ -47,13 +132,154 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
                  also informs the user that the connection will be closed.
                  */
                 w.Header().Set("Connection", "close")
+                app.metrics.panics.Inc()
                 // Call the app.serverError helper method to return a 500
                 // Internal Server response.
-                app.serverError(w, fmt.Errorf("%s", err))
+                app.serverError(w, r, fmt.Errorf("%s", err))
             }
         }()
         
         next.ServeHTTP(w, r)
     })
 }
-    
\ No newline at end of file
+    
+func (app *application) requireAuthentication(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        // If the user is not authenticated, redirect them to the login page and
+        // return from the middleware chain so that no subsequent handlers in
+        // the chain are executed.
+        if !app.isAuthenticated(r) {
+            http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+            return
+        }
+
+        // Pages behind a login should not be stored in the browser cache (or
+        // any intermediary cache).
+        w.Header().Add("Cache-Control", "no-store")
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+func (app *application) authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+        if id == 0 {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        // The session may outlive the account, so check the user still exists
+        // before trusting the ID stored in the session.
+        user, err := app.user.Get(r.Context(), id)
+        if err != nil && !errors.Is(err, models.ErrNoRecord) {
+            app.serverError(w, r, err)
+            return
+        }
+
+        // The session may also have been signed out from another device, or
+        // the account disabled by an admin.
+        if user != nil && user.Disabled {
+            app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+            user = nil
+        }
+
+        if user != nil {
+            active, err := app.userSession.Seen(app.sessionManager.Token(r.Context()), user.ID, clientIP(r))
+            if err != nil {
+                app.serverError(w, r, err)
+                return
+            }
+
+            if !active {
+                app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+                user = nil
+            }
+        }
+
+        if user != nil {
+            // let the rate limiter count the next requests of the session by
+            // account
+            app.limiter.rememberSession(app.sessionManager.Token(r.Context()), user.ID, time.Now())
+
+            ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
+            ctx = context.WithValue(ctx, userContextKey, user)
+            r = r.WithContext(ctx)
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// requireVerified only let users with a verified email through, when the
+// application is configured to require it.
+func (app *application) requireVerified(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        if !app.requireVerifiedEmail {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        user := app.authenticatedUser(r)
+        if user == nil {
+            http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+            return
+        }
+
+        if !user.Verified {
+            app.sessionManager.Put(r.Context(), "flash", "Please verify your email address first.")
+            http.Redirect(w, r, "/user/verify/pending", http.StatusSeeOther)
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// requireRole only let users with the role (or a more powerful one) through,
+// it must come after requireAuthentication in the chain.
+func (app *application) requireRole(role string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+            user := app.authenticatedUser(r)
+            if user == nil || !user.HasRole(role) {
+                app.clientError(w, http.StatusForbidden)
+                return
+            }
+
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// rateLimit refuse the requests of clients going over the limit of the request
+// class with 429 Too Many Requests. Logged in users are counted by account,
+// so users sharing an IP don't share a limit, the others by IP.
+func (app *application) rateLimit(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        // static files are cheap and a single page needs several of them, the
+        // probes must never be refused
+        if strings.HasPrefix(r.URL.Path, "/static/") || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        res, limited := app.limiter.take(rateClass(r), app.rateLimitClient(r), time.Now())
+        if !limited {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Set("RateLimit-Limit", strconv.Itoa(res.limit))
+        w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.remaining))
+        w.Header().Set("RateLimit-Reset", strconv.Itoa(int(res.reset.Seconds())))
+
+        if !res.allowed {
+            w.Header().Set("Retry-After", strconv.Itoa(int(res.retryAfter.Seconds())))
+            app.clientError(w, http.StatusTooManyRequests)
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
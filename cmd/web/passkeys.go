@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"snippetbox.kamanazan.net/internal/models"
+)
+
+// webauthnUser adapt a models.Users and its passkeys to the webauthn.User
+// interface expected by the WebAuthn ceremonies.
+type webauthnUser struct {
+	user        *models.Users
+	credentials []webauthn.Credential
+}
+
+// The user handle is the user ID, it is stored by the authenticator and sent
+// back during a passkey login to tell us who is logging in.
+func (u *webauthnUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(u.user.ID))
+}
+
+func (u *webauthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *webauthnUser) WebAuthnDisplayName() string {
+	return u.user.Name
+}
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func (u *webauthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+// loadWebauthnUser returns the user with all their registered passkeys.
+func (app *application) loadWebauthnUser(user *models.Users) (*webauthnUser, error) {
+	stored, err := app.credential.ByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	wu := &webauthnUser{user: user}
+
+	for _, c := range stored {
+		var credential webauthn.Credential
+		err := json.Unmarshal(c.Data, &credential)
+		if err != nil {
+			return nil, err
+		}
+		wu.credentials = append(wu.credentials, credential)
+	}
+
+	return wu, nil
+}
+
+// discoverableUser find the owner of the passkey used for a passwordless login.
+// The user handle sent by the authenticator must match the owner of the
+// credential.
+func (app *application) discoverableUser(ctx context.Context, rawID, userHandle []byte) (webauthn.User, error) {
+	credential, err := app.credential.Get(rawID)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(userHandle) != strconv.Itoa(credential.UserID) {
+		return nil, errors.New("user handle doesn't match the credential owner")
+	}
+
+	user, err := app.user.Get(ctx, credential.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Disabled {
+		return nil, models.ErrAccountDisabled
+	}
+
+	return app.loadWebauthnUser(user)
+}
+
+// putWebauthnSession keep the data of an ongoing ceremony (mostly the
+// challenge) in the session until the browser answers.
+func (app *application) putWebauthnSession(r *http.Request, key string, session *webauthn.SessionData) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	app.sessionManager.Put(r.Context(), key, data)
+	return nil
+}
+
+// popWebauthnSession returns and remove the ceremony data, a challenge can only
+// be answered once.
+func (app *application) popWebauthnSession(r *http.Request, key string) (*webauthn.SessionData, error) {
+	data := app.sessionManager.PopBytes(r.Context(), key)
+	if data == nil {
+		return nil, errors.New("no WebAuthn ceremony in progress")
+	}
+
+	session := &webauthn.SessionData{}
+	err := json.Unmarshal(data, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"snippetbox.kamanazan.net/internal/models"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "https://localhost:4000"
+)
+
+// softAuthenticator is a passkey kept in memory, it answers the WebAuthn
+// ceremonies like a browser and a platform authenticator would.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	counter      uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &softAuthenticator{key: key, credentialID: id}
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// authData returns the authenticator data: RP ID hash, flags (user present and
+// verified) and sign counter, followed by attested when given.
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags|0x01|0x04)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, attested...)
+}
+
+// register answer navigator.credentials.create() with a "none" attestation.
+func (a *softAuthenticator) register(t *testing.T, creation *protocol.CredentialCreation) []byte {
+	a.userHandle = creation.Response.User.ID.(protocol.URLEncodedBase64)
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AAGUID, credential ID length and ID, public key
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(0x40, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.response(t, map[string]string{
+		"clientDataJSON":    b64(a.clientData(t, "webauthn.create", creation.Response.Challenge)),
+		"attestationObject": b64(attestation),
+	})
+}
+
+// login answer navigator.credentials.get(), the sign counter is increased
+// first like a real authenticator does.
+func (a *softAuthenticator) login(t *testing.T, assertion *protocol.CredentialAssertion) []byte {
+	a.counter++
+
+	clientData := a.clientData(t, "webauthn.get", assertion.Response.Challenge)
+	authData := a.authData(0, nil)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.response(t, map[string]string{
+		"clientDataJSON":    b64(clientData),
+		"authenticatorData": b64(authData),
+		"signature":         b64(signature),
+		"userHandle":        b64(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) response(t *testing.T, response map[string]string) []byte {
+	body, err := json.Marshal(map[string]any{
+		"id":       b64(a.credentialID),
+		"rawId":    b64(a.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newTestPasskeyApp(t *testing.T) (*application, context.Context) {
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          testRPID,
+		RPDisplayName: "Snippetbox",
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{webauthn: webAuthn, sessionManager: scs.New()}
+
+	ctx, err := app.sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return app, ctx
+}
+
+func newCeremonyRequest(ctx context.Context, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	return r.WithContext(ctx)
+}
+
+// TestPasskeyCeremonies register a passkey and log in with it the way the
+// passkey handlers do, including the round trip of the ceremony data through
+// the session.
+func TestPasskeyCeremonies(t *testing.T) {
+	app, ctx := newTestPasskeyApp(t)
+	r := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx)
+
+	user := &webauthnUser{user: &models.Users{ID: 42, Name: "Alice", Email: "alice@example.com"}}
+	authenticator := newSoftAuthenticator(t)
+
+	// registration
+	creation, session, err := app.webauthn.BeginRegistration(user,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.putWebauthnSession(r, "webauthnRegistration", session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err = app.popWebauthnSession(r, "webauthnRegistration")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := app.webauthn.FinishRegistration(user, *session, newCeremonyRequest(ctx, authenticator.register(t, creation)))
+	if err != nil {
+		t.Fatalf("registration: %s", err)
+	}
+
+	if !bytes.Equal(credential.ID, authenticator.credentialID) {
+		t.Fatalf("registered credential %x, want %x", credential.ID, authenticator.credentialID)
+	}
+
+	// the challenge can only be answered once
+	if _, err := app.popWebauthnSession(r, "webauthnRegistration"); err == nil {
+		t.Error("the registration session is still there")
+	}
+
+	// the credential is stored as JSON, like the handlers do
+	stored, err := json.Marshal(credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(rawID, userHandle []byte) (webauthn.User, error) {
+		if !bytes.Equal(rawID, authenticator.credentialID) || string(userHandle) != "42" {
+			t.Fatalf("unexpected lookup of %x for user handle %q", rawID, userHandle)
+		}
+
+		var c webauthn.Credential
+		err := json.Unmarshal(stored, &c)
+		if err != nil {
+			return nil, err
+		}
+
+		return &webauthnUser{user: user.user, credentials: []webauthn.Credential{c}}, nil
+	}
+
+	login := func(a *softAuthenticator) (*webauthn.Credential, error) {
+		assertion, session, err := app.webauthn.BeginDiscoverableLogin()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.putWebauthnSession(r, "webauthnLogin", session)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session, err = app.popWebauthnSession(r, "webauthnLogin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return app.webauthn.FinishDiscoverableLogin(lookup, *session, newCeremonyRequest(ctx, a.login(t, assertion)))
+	}
+
+	// a copy of the authenticator, the sign counters of the two will collide
+	clone := *authenticator
+
+	for i := 1; i <= 2; i++ {
+		credential, err = login(authenticator)
+		if err != nil {
+			t.Fatalf("login %d: %s", i, err)
+		}
+
+		if credential.Authenticator.CloneWarning {
+			t.Fatalf("login %d: unexpected clone warning", i)
+		}
+		if credential.Authenticator.SignCount != uint32(i) {
+			t.Errorf("login %d: sign count %d, want %d", i, credential.Authenticator.SignCount, i)
+		}
+
+		stored, err = json.Marshal(credential)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// passkeyLoginFinishPost refuse the login when the counter goes backwards
+	credential, err = login(&clone)
+	if err != nil {
+		t.Fatalf("login with the clone: %s", err)
+	}
+	if !credential.Authenticator.CloneWarning {
+		t.Error("no clone warning for a sign counter going backwards")
+	}
+
+	// a wrong key is refused outright
+	impostor := newSoftAuthenticator(t)
+	impostor.credentialID = authenticator.credentialID
+	impostor.userHandle = authenticator.userHandle
+	impostor.counter = 10
+
+	_, err = login(impostor)
+	if err == nil {
+		t.Error("login with another key succeeded")
+	}
+}
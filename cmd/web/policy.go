@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"snippetbox.kamanazan.net/internal/policy"
+)
+
+// contentPolicy decide what happens to a new snippet, *policy.Engine is the
+// implementation used by the application.
+type contentPolicy interface {
+	Evaluate(s *policy.Submission) policy.Verdict
+}
+
+// snippetQuota is the number of snippets a user, or a client, can create per
+// quotaWindow. 0 disables the quota.
+type snippetQuota struct {
+	perUser int
+	perIP   int
+}
+
+const quotaWindow = time.Hour
+
+// newContentPolicy returns the spam heuristics used for new snippets. A single
+// strong signal quarantines a snippet, rejecting takes several.
+func newContentPolicy(quarantineAt, rejectAt float64, blockedDomains, blockedKeywords string) *policy.Engine {
+	return &policy.Engine{
+		Rules: []policy.Rule{
+			policy.LinkDensity{MinLinks: 5, MaxRatio: 0.3, Score: 4},
+			policy.Repetition{MinLines: 10, MinDistinct: 0.3, Score: 4},
+			policy.BlockedTerms{Domains: policy.Terms(blockedDomains), Keywords: policy.Terms(blockedKeywords), Score: 6},
+			policy.NewAccountRate{MinAge: 24 * time.Hour, MaxSnippets: 5, Score: 5},
+		},
+		QuarantineAt: quarantineAt,
+		RejectAt:     rejectAt,
+	}
+}
+
+// evaluateSnippet score the snippet the user is creating against the content
+// policy. Without -require-verified anonymous users can post too, the rules
+// about the account don't apply to them.
+func (app *application) evaluateSnippet(r *http.Request, form *snippetCreateForm) (policy.Verdict, error) {
+	submission := &policy.Submission{
+		Title:   form.Title,
+		Content: form.Content,
+	}
+
+	if id := app.authenticatedUserID(r); id != 0 {
+		age, recent, err := app.user.PostingActivity(r.Context(), id)
+		if err != nil {
+			return policy.Verdict{}, err
+		}
+		submission.AccountAge = age
+		submission.RecentSnippets = recent
+	} else {
+		submission.Anonymous = true
+	}
+
+	return app.contentPolicy.Evaluate(submission), nil
+}
+
+// takeSnippetQuota count a new snippet against the quotas of the user and of
+// the client. It returns how long until another snippet can be created, zero
+// when this one is allowed. Anonymous users only have the quota of their
+// client, they must not share a single bucket.
+func (app *application) takeSnippetQuota(r *http.Request) (time.Duration, error) {
+	var wait time.Duration
+
+	if id := app.authenticatedUserID(r); app.snippetQuota.perUser > 0 && id != 0 {
+		key := fmt.Sprintf("snippet:user:%d", id)
+		d, err := app.quota.Take(key, app.snippetQuota.perUser, quotaWindow)
+		if err != nil {
+			return 0, err
+		}
+		wait = max(wait, d)
+	}
+
+	if app.snippetQuota.perIP > 0 {
+		d, err := app.quota.Take("snippet:ip:"+clientIP(r), app.snippetQuota.perIP, quotaWindow)
+		if err != nil {
+			return 0, err
+		}
+		wait = max(wait, d)
+	}
+
+	return wait, nil
+}
+
+// policyReason summarize a verdict for the moderation queue.
+func policyReason(v policy.Verdict) string {
+	reason := fmt.Sprintf("Spam score %.1f: %s", v.Score, strings.Join(v.Reasons, "; "))
+	if runes := []rune(reason); len(runes) > 500 {
+		reason = string(runes[:497]) + "..."
+	}
+	return reason
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request classes, each with its own limit. Auth covers the forms attempting
+// a login or sending mails, they are the favourite of scripts.
+const (
+	rateRead  = "read"
+	rateWrite = "write"
+	rateAuth  = "auth"
+)
+
+var rateAuthPaths = []string{"/user/login", "/user/signup", "/user/password"}
+
+// Buckets untouched for that long are full again and can be forgotten.
+const rateEvictInterval = time.Minute
+
+// rateBucket is a token bucket, a request takes a token and tokens come back
+// at a steady rate up to the capacity of the bucket.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateSession is a session token seen with a logged in user.
+type rateSession struct {
+	userID int
+	seen   time.Time
+}
+
+// Sessions unseen for that long are forgotten, their next request is counted
+// by IP until authenticate see them again.
+const rateSessionTTL = 30 * time.Minute
+
+// rateLimiter keep a token bucket per client and request class in memory.
+// Every instance of the application count its own requests.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	// requests per minute by class, also the burst allowed, 0 for no limit
+	limits map[string]int
+	// user of the session tokens, so logged in users are counted by account
+	// without loading their session
+	sessions map[string]rateSession
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newRateLimiter(limits map[string]int) *rateLimiter {
+	rl := &rateLimiter{
+		buckets:  map[string]*rateBucket{},
+		limits:   limits,
+		sessions: map[string]rateSession{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go rl.run()
+
+	return rl
+}
+
+func (rl *rateLimiter) run() {
+	defer close(rl.done)
+
+	ticker := time.NewTicker(rateEvictInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			rl.evict(now)
+		case <-rl.stop:
+			return
+		}
+	}
+}
+
+// evict forget the buckets which are full again, a new bucket would be the
+// same.
+func (rl *rateLimiter) evict(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for key, b := range rl.buckets {
+		class, _, _ := strings.Cut(key, " ")
+		limit := float64(rl.limits[class])
+		if b.tokens+now.Sub(b.last).Minutes()*limit >= limit {
+			delete(rl.buckets, key)
+		}
+	}
+
+	for token, session := range rl.sessions {
+		if now.Sub(session.seen) > rateSessionTTL {
+			delete(rl.sessions, token)
+		}
+	}
+}
+
+// rememberSession record the user of a session token.
+func (rl *rateLimiter) rememberSession(token string, userID int, now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.sessions[token] = rateSession{userID: userID, seen: now}
+}
+
+// sessionUser returns the user of a session token, 0 when unknown.
+func (rl *rateLimiter) sessionUser(token string) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.sessions[token].userID
+}
+
+// Close stop the eviction goroutine.
+func (rl *rateLimiter) Close() {
+	close(rl.stop)
+	<-rl.done
+}
+
+// rateLimitResult is what the client is told about its bucket.
+type rateLimitResult struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// until the next token when the request is refused
+	retryAfter time.Duration
+	// until the bucket is full again
+	reset time.Duration
+}
+
+// take a token from the bucket of the client for the request class. ok is
+// false when the class has no limit.
+func (rl *rateLimiter) take(class, client string, now time.Time) (res rateLimitResult, ok bool) {
+	limit := rl.limits[class]
+	if limit <= 0 {
+		return res, false
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	key := class + " " + client
+	b, exists := rl.buckets[key]
+	if !exists {
+		b = &rateBucket{tokens: float64(limit), last: now}
+		rl.buckets[key] = b
+	}
+
+	perSecond := float64(limit) / 60
+	b.tokens = math.Min(float64(limit), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	res.limit = limit
+	if b.tokens >= 1 {
+		b.tokens--
+		res.allowed = true
+	} else {
+		res.retryAfter = seconds((1 - b.tokens) / perSecond)
+	}
+	res.remaining = int(b.tokens)
+	res.reset = seconds((float64(limit) - b.tokens) / perSecond)
+
+	return res, true
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s)) * time.Second
+}
+
+// rateClass returns the class of the request, reads are the safe methods.
+func rateClass(r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return rateRead
+	}
+
+	for _, prefix := range rateAuthPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return rateAuth
+		}
+	}
+
+	return rateWrite
+}
+
+// rateLimitClient identify the client for the rate limiter. The middleware
+// runs before LoadAndSave and must not hit the session store, a client over
+// its limit would still cost a query. The session cookie is looked up in the
+// sessions authenticate told the limiter about instead, other clients are
+// counted by IP.
+func (app *application) rateLimitClient(r *http.Request) string {
+	cookie, err := r.Cookie(app.sessionManager.Cookie.Name)
+	if err == nil {
+		if id := app.limiter.sessionUser(cookie.Value); id != 0 {
+			return "user:" + strconv.Itoa(id)
+		}
+	}
+
+	return "ip:" + clientIP(r)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.1, 192.168.0.0/16, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:51234", nil, "203.0.113.7"},
+		{"forged by a direct client", "203.0.113.7:51234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"behind a proxy", "10.0.0.1:443", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"proxy without header", "10.0.0.1:443", nil, "10.0.0.1"},
+		{"forged before the proxy", "10.0.0.1:443", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.1:443", []string{"198.51.100.1, 192.168.4.2"}, "198.51.100.1"},
+		{"several headers", "10.0.0.1:443", []string{"1.2.3.4", "198.51.100.1, 192.168.4.2"}, "198.51.100.1"},
+		{"only proxies", "10.0.0.1:443", []string{"192.168.4.2"}, "192.168.4.2"},
+		{"garbage", "10.0.0.1:443", []string{"1.2.3.4, not-an-ip"}, "10.0.0.1"},
+		{"IPv6 proxy", "[::1]:443", []string{"2001:db8::7"}, "2001:db8::7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := forwardedClientIP(r, trusted); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{trustedProxies: trusted}
+
+	var got string
+	handler := app.realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientIP(r)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:443"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got != "198.51.100.1" {
+		t.Errorf("clientIP after realIP = %q, want 198.51.100.1", got)
+	}
+
+	// without the middleware it is the peer of the connection
+	if ip := clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("clientIP without realIP = %q, want 10.0.0.1", ip)
+	}
+}
+
+func TestRateLimitClient(t *testing.T) {
+	limiter := newRateLimiter(map[string]int{rateRead: 60})
+	t.Cleanup(limiter.Close)
+
+	// the session store is never reached, scs.New() keeps it in memory and
+	// knows none of the tokens
+	app := &application{sessionManager: scs.New(), limiter: limiter}
+
+	request := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "203.0.113.7:51234"
+		if token != "" {
+			r.AddCookie(&http.Cookie{Name: app.sessionManager.Cookie.Name, Value: token})
+		}
+		return r
+	}
+
+	if got := app.rateLimitClient(request("")); got != "ip:203.0.113.7" {
+		t.Errorf("without session got %q", got)
+	}
+	if got := app.rateLimitClient(request("unknown")); got != "ip:203.0.113.7" {
+		t.Errorf("unknown session got %q", got)
+	}
+
+	now := time.Now()
+	limiter.rememberSession("known", 42, now)
+
+	if got := app.rateLimitClient(request("known")); got != "user:42" {
+		t.Errorf("known session got %q", got)
+	}
+
+	limiter.evict(now.Add(rateSessionTTL + time.Second))
+
+	if got := app.rateLimitClient(request("known")); got != "ip:203.0.113.7" {
+		t.Errorf("forgotten session got %q", got)
+	}
+}
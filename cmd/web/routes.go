@@ -5,10 +5,11 @@ import (
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/justinas/alice"
+	"snippetbox.kamanazan.net/internal/models"
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
+	router := &instrumentedRouter{Router: httprouter.New()}
 	// Create a handler function which wraps our notFound() helper, and then
 	// assign it as the custom handler for 404 Not Found responses. You can also
 	// set a custom handler for 405 Method Not Allowed responses by setting
@@ -31,23 +32,133 @@ func (app *application) routes() http.Handler {
 	*/
 	router.Handler(http.MethodGet, "/static/*filepath", http.StripPrefix("/static", fileServer))
 
+	// Feeds are read by feed readers which don't keep cookies, so they don't
+	// need the session middleware.
+	router.HandlerFunc(http.MethodGet, "/feed.atom", app.feedAtom)
+	router.HandlerFunc(http.MethodGet, "/feed.rss", app.feedRSS)
+	router.HandlerFunc(http.MethodGet, "/feed/user/:id/:format", app.userFeed)
+
+	// Probes of the orchestrator and build information, they must answer even
+	// when the session store is down.
+	router.HandlerFunc(http.MethodGet, "/healthz", app.healthz)
+	router.HandlerFunc(http.MethodGet, "/readyz", app.readyz)
+	router.HandlerFunc(http.MethodGet, "/version", app.version)
+
+	// The embeddable snippet is the only page allowed inside an iframe, and the
+	// oEmbed endpoint is called by the embedding site's server.
+	router.Handler(http.MethodGet, "/snippet/embed/:id", alice.New(app.allowFraming).ThenFunc(app.embedSnippet))
+	router.HandlerFunc(http.MethodGet, "/oembed", app.oembed)
+
 	// Create a new middleware chain containing the middleware specific to our
-	// dynamic application routes. For now, this chain will only contain the
-	// LoadAndSave session middleware but we'll add more to it later.
-	dynamic := alice.New(app.sessionManager.LoadAndSave)
+	// dynamic application routes. LoadAndSave must come first so the session
+	// data is available to the authenticate middleware.
+	dynamic := alice.New(app.sessionManager.LoadAndSave, app.authenticate)
 
 	router.Handler(http.MethodGet, "/", dynamic.ThenFunc(app.home))
-	router.Handler(http.MethodGet, "/snippet/create", dynamic.ThenFunc(app.createSnippet))
-	router.Handler(http.MethodPost, "/snippet/create", dynamic.ThenFunc(app.createSnippetPost))
+	// Creating snippets can be restricted to users with a verified email.
+	verified := dynamic.Append(app.requireVerified)
+
+	router.Handler(http.MethodGet, "/snippet/create", verified.ThenFunc(app.createSnippet))
+	router.Handler(http.MethodPost, "/snippet/create", verified.ThenFunc(app.createSnippetPost))
 	router.Handler(http.MethodGet, "/snippet/view/:id", dynamic.ThenFunc(app.viewSnippet))
 
 	router.Handler(http.MethodGet, "/user/signup", dynamic.ThenFunc(app.userSignup))
 	router.Handler(http.MethodPost, "/user/signup", dynamic.ThenFunc(app.userSignupPost))
 	router.Handler(http.MethodGet, "/user/login", dynamic.ThenFunc(app.userLogin))
 	router.Handler(http.MethodPost, "/user/login", dynamic.ThenFunc(app.userLoginPost))
-	router.Handler(http.MethodPost, "/user/logout", dynamic.ThenFunc(app.userLogoutPost))
+	router.Handler(http.MethodGet, "/user/login/2fa", dynamic.ThenFunc(app.userLoginTwoFactor))
+	router.Handler(http.MethodPost, "/user/login/2fa", dynamic.ThenFunc(app.userLoginTwoFactorPost))
+	router.Handler(http.MethodPost, "/user/login/passkey/begin", dynamic.ThenFunc(app.passkeyLoginBeginPost))
+	router.Handler(http.MethodPost, "/user/login/passkey/finish", dynamic.ThenFunc(app.passkeyLoginFinishPost))
+	router.Handler(http.MethodGet, "/user/login/sso", dynamic.ThenFunc(app.ssoLogin))
+	router.Handler(http.MethodGet, "/user/login/sso/callback", dynamic.ThenFunc(app.ssoCallback))
+	router.Handler(http.MethodGet, "/user/verify", dynamic.ThenFunc(app.verifyEmail))
+	router.Handler(http.MethodGet, "/user/password/forgot", dynamic.ThenFunc(app.passwordForgot))
+	router.Handler(http.MethodPost, "/user/password/forgot", dynamic.ThenFunc(app.passwordForgotPost))
+	router.Handler(http.MethodGet, "/user/password/reset/:token", dynamic.ThenFunc(app.passwordReset))
+	router.Handler(http.MethodPost, "/user/password/reset/:token", dynamic.ThenFunc(app.passwordResetPost))
+
+	router.Handler(http.MethodGet, "/collection/:ref", dynamic.ThenFunc(app.viewCollection))
+
+	// Routes that are only available to logged in users. alice chains are
+	// immutable so Append() return a new chain and leave 'dynamic' untouched.
+	protected := dynamic.Append(app.requireAuthentication)
+
+	router.Handler(http.MethodPost, "/snippet/star/:id", protected.ThenFunc(app.starSnippetPost))
+	router.Handler(http.MethodPost, "/snippet/unstar/:id", protected.ThenFunc(app.unstarSnippetPost))
+
+	router.Handler(http.MethodPost, "/snippet/collect/:id", protected.ThenFunc(app.collectSnippetPost))
+	router.Handler(http.MethodGet, "/snippet/analytics/:id", protected.ThenFunc(app.snippetAnalytics))
+	router.Handler(http.MethodPost, "/snippet/delete/:id", protected.ThenFunc(app.deleteSnippetPost))
+
+	router.Handler(http.MethodGet, "/user/starred", protected.ThenFunc(app.userStarred))
+	router.Handler(http.MethodGet, "/user/collections", protected.ThenFunc(app.userCollections))
+	router.Handler(http.MethodPost, "/user/collections", protected.ThenFunc(app.userCollectionsPost))
+
+	// httprouter doesn't allow a static segment next to the :ref parameter
+	// (e.g. /collection/create) so management pages live under the reference.
+	router.Handler(http.MethodGet, "/collection/:ref/edit", protected.ThenFunc(app.editCollection))
+	router.Handler(http.MethodPost, "/collection/:ref/edit", protected.ThenFunc(app.editCollectionPost))
+	router.Handler(http.MethodPost, "/collection/:ref/reorder", protected.ThenFunc(app.reorderCollectionPost))
+	router.Handler(http.MethodPost, "/collection/:ref/remove", protected.ThenFunc(app.removeFromCollectionPost))
+	router.Handler(http.MethodPost, "/collection/:ref/delete", protected.ThenFunc(app.deleteCollectionPost))
+	router.Handler(http.MethodPost, "/user/logout", protected.ThenFunc(app.userLogoutPost))
+	router.Handler(http.MethodGet, "/user/verify/pending", protected.ThenFunc(app.verifyPending))
+	router.Handler(http.MethodPost, "/user/verify/resend", protected.ThenFunc(app.verifyResendPost))
+
+	router.Handler(http.MethodGet, "/user/2fa", protected.ThenFunc(app.twoFactor))
+	router.Handler(http.MethodGet, "/user/2fa/setup", protected.ThenFunc(app.twoFactorSetup))
+	router.Handler(http.MethodPost, "/user/2fa/setup", protected.ThenFunc(app.twoFactorSetupPost))
+	router.Handler(http.MethodGet, "/user/2fa/qr.png", protected.ThenFunc(app.twoFactorQR))
+	router.Handler(http.MethodPost, "/user/2fa/enable", protected.ThenFunc(app.twoFactorEnablePost))
+	router.Handler(http.MethodPost, "/user/2fa/disable", protected.ThenFunc(app.twoFactorDisablePost))
+	router.Handler(http.MethodPost, "/user/2fa/recovery", protected.ThenFunc(app.twoFactorRecoveryPost))
+
+	router.Handler(http.MethodGet, "/user/passkeys", protected.ThenFunc(app.passkeys))
+	router.Handler(http.MethodPost, "/user/passkeys/register/begin", protected.ThenFunc(app.passkeyRegisterBeginPost))
+	router.Handler(http.MethodPost, "/user/passkeys/register/finish", protected.ThenFunc(app.passkeyRegisterFinishPost))
+	router.Handler(http.MethodPost, "/user/passkeys/delete", protected.ThenFunc(app.passkeyDeletePost))
+
+	router.Handler(http.MethodGet, "/account/view", protected.ThenFunc(app.accountView))
+	router.Handler(http.MethodPost, "/account/update", protected.ThenFunc(app.accountUpdatePost))
+	router.Handler(http.MethodGet, "/account/password/update", protected.ThenFunc(app.passwordUpdate))
+	router.Handler(http.MethodPost, "/account/password/update", protected.ThenFunc(app.passwordUpdatePost))
+	router.Handler(http.MethodGet, "/account/sessions", protected.ThenFunc(app.accountSessions))
+	router.Handler(http.MethodPost, "/account/sessions/revoke", protected.ThenFunc(app.revokeSessionPost))
+	router.Handler(http.MethodPost, "/account/sessions/revoke-all", protected.ThenFunc(app.revokeAllSessionsPost))
+
+	router.Handler(http.MethodGet, "/snippet/report/:id", protected.ThenFunc(app.reportSnippet))
+	router.Handler(http.MethodPost, "/snippet/report/:id", protected.ThenFunc(app.reportSnippetPost))
+
+	moderator := protected.Append(app.requireRole(models.RoleModerator))
+
+	router.Handler(http.MethodGet, "/moderation", moderator.ThenFunc(app.moderationQueue))
+	router.Handler(http.MethodPost, "/moderation/:id/dismiss", moderator.ThenFunc(app.moderationDismissPost))
+	router.Handler(http.MethodPost, "/moderation/:id/hide", moderator.ThenFunc(app.moderationHidePost))
+	router.Handler(http.MethodPost, "/moderation/:id/delete", moderator.ThenFunc(app.moderationDeletePost))
+
+	admin := protected.Append(app.requireRole(models.RoleAdmin))
+
+	router.Handler(http.MethodGet, "/admin", admin.ThenFunc(app.adminDashboard))
+	router.Handler(http.MethodGet, "/admin/users", admin.ThenFunc(app.adminUsers))
+	router.Handler(http.MethodPost, "/admin/users/:id/disable", admin.ThenFunc(app.adminUserDisablePost))
+	router.Handler(http.MethodPost, "/admin/users/:id/enable", admin.ThenFunc(app.adminUserEnablePost))
+	router.Handler(http.MethodGet, "/admin/snippets", admin.ThenFunc(app.adminSnippets))
+	router.Handler(http.MethodPost, "/admin/snippets/:id/expire", admin.ThenFunc(app.adminSnippetExpirePost))
+	router.Handler(http.MethodPost, "/admin/snippets/:id/delete", admin.ThenFunc(app.adminSnippetDeletePost))
+	router.Handler(http.MethodGet, "/admin/audit", admin.ThenFunc(app.adminAudit))
+	router.Handler(http.MethodGet, "/admin/audit.csv", admin.ThenFunc(app.adminAuditExport))
+
+	// Metrics are scraped by Prometheus on their own listener, which must not
+	// be reachable from the internet. Without it, they tell too much about
+	// the server to be public.
+	if app.metricsAddr == "" {
+		router.Handler(http.MethodGet, "/metrics", admin.Then(app.metrics.handler()))
+	}
 
-	middlewares := alice.New(app.recoverPanic, app.logRequest, secureHeaders)
+	// recoverPanic comes after logRequest and instrument so a request ending
+	// in a panic is logged and counted with its 500 status.
+	middlewares := alice.New(app.realIP, app.requestID, app.instrument, app.trace, app.logRequest, app.recoverPanic, secureHeaders, app.rateLimit)
 
 	return middlewares.Then(router)
 }
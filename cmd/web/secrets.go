@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"snippetbox.kamanazan.net/internal/secrets"
+)
+
+// What to do with a snippet containing secrets: refuse it, ask the user to
+// confirm, or publish it with the secrets replaced by a placeholder.
+const (
+	secretScanBlock  = "block"
+	secretScanWarn   = "warn"
+	secretScanRedact = "redact"
+)
+
+var secretScanModes = []string{secretScanBlock, secretScanWarn, secretScanRedact}
+
+// scanSecrets look for credentials in the content of the snippet and apply the
+// configured policy, the problems are reported as errors on the content field.
+// It returns what was found.
+func (app *application) scanSecrets(form *snippetCreateForm) []secrets.Match {
+	matches := secrets.Scan(form.Content)
+	if len(matches) == 0 {
+		return nil
+	}
+
+	switch app.secretScan {
+	case secretScanBlock:
+		form.AddFieldError("content", "This looks like it contains secrets, remove them before publishing: "+describeSecrets(matches))
+	case secretScanWarn:
+		form.SecretsFound = true
+		if !form.PublishSecrets {
+			form.AddFieldError("content", "This looks like it contains secrets, everybody will be able to read them: "+describeSecrets(matches))
+		}
+	case secretScanRedact:
+		form.Content = secrets.Redact(form.Content, matches)
+	}
+
+	return matches
+}
+
+func describeSecrets(matches []secrets.Match) string {
+	found := make([]string, len(matches))
+	for i, m := range matches {
+		found[i] = fmt.Sprintf("%s on line %d", m.Kind, m.Line)
+	}
+	return strings.Join(found, ", ")
+}
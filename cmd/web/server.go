@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve run srv, and the metrics server when there is one, until the process
+// gets SIGINT or SIGTERM. It then shuts down gracefully: /readyz starts
+// failing, after delay the servers stop accepting connections and finish the
+// requests in flight, then the background work is drained. Everything must be
+// done within timeout.
+func (app *application) serve(srv, metricsSrv *http.Server, delay, timeout time.Duration) error {
+	serverErrors := make(chan error, 2)
+
+	go func() {
+		app.logger.Info("starting server", "addr", srv.Addr)
+		serverErrors <- srv.ListenAndServeTLS("./tls/cert.pem", "./tls/key.pem")
+	}()
+
+	// The metrics listener is meant for a private network, it has no TLS and
+	// no middleware.
+	if metricsSrv != nil {
+		go func() {
+			app.logger.Info("starting metrics server", "addr", metricsSrv.Addr)
+			serverErrors <- metricsSrv.ListenAndServe()
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-serverErrors:
+		// a server couldn't start, e.g. the address is already in use
+		return err
+	case <-ctx.Done():
+	}
+
+	// restore the default behaviour, a second signal kills the process
+	stop()
+
+	app.logger.Info("shutting down", "delay", delay, "timeout", timeout)
+
+	// Keep serving while the load balancer notices the failing readiness
+	// probe and stops sending new requests.
+	app.shuttingDown.Store(true)
+	time.Sleep(delay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if metricsSrv != nil {
+		err = errors.Join(err, metricsSrv.Shutdown(shutdownCtx))
+	}
+
+	// mails and other work started by the handlers
+	drained := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		app.logger.Warn("background tasks still running at the end of the shutdown timeout")
+	}
+
+	app.viewRecorder.Close()
+	app.limiter.Close()
+
+	return err
+}
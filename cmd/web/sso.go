@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"snippetbox.kamanazan.net/internal/validator"
+)
+
+// ssoProvider hold the configuration of the OpenID Connect identity provider
+// used for the "Sign in with company SSO" login.
+type ssoProvider struct {
+	issuer   string
+	verifier *oidc.IDTokenVerifier
+	oauth2   *oauth2.Config
+	// email domains allowed to login, any verified email when empty
+	allowedDomains []string
+}
+
+// ssoClaims are the ID token claims we use to find or create the account.
+type ssoClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// newSSOProvider fetch the provider configuration from its discovery document
+// (<issuer>/.well-known/openid-configuration).
+func newSSOProvider(ctx context.Context, issuer, clientID, clientSecret, redirectURL, allowedDomains string) (*ssoProvider, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	sso := &ssoProvider{
+		issuer:   issuer,
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		oauth2: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+	}
+
+	for _, domain := range strings.Split(allowedDomains, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			sso.allowedDomains = append(sso.allowedDomains, domain)
+		}
+	}
+
+	return sso, nil
+}
+
+// allowedEmail check the domain of the email against the allowed domains.
+func (sso *ssoProvider) allowedEmail(email string) bool {
+	if len(sso.allowedDomains) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range sso.allowedDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// account returns the name of the account of the identity, ok is false when
+// the identity can't log in: accounts are linked by email, so it must be a
+// valid email verified by the provider and in an allowed domain. The name
+// default to the local part of the email.
+func (sso *ssoProvider) account(claims *ssoClaims) (name string, ok bool) {
+	if !validator.ValidEmail(claims.Email) || !claims.EmailVerified || !sso.allowedEmail(claims.Email) {
+		return "", false
+	}
+
+	name = claims.Name
+	if name == "" {
+		name = claims.Email[:strings.LastIndex(claims.Email, "@")]
+	}
+	return name, true
+}
+
+// subject returns the identifier linking an account to the identity, the sub
+// claim is only unique for a given issuer.
+func (sso *ssoProvider) subject(sub string) string {
+	return sso.issuer + " " + sub
+}
+
+// exchange trade the authorization code for the tokens of the user, with the
+// PKCE verifier of the login. The ID token is checked (signature, issuer,
+// audience, expiry and nonce) before its claims are trusted. It returns the
+// identifier of the identity, see subject.
+func (sso *ssoProvider) exchange(ctx context.Context, code, verifier, nonce string) (string, *ssoClaims, error) {
+	token, err := sso.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return "", nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", nil, errors.New("no id_token in the token response")
+	}
+
+	idToken, err := sso.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if nonce == "" || !hmac.Equal([]byte(idToken.Nonce), []byte(nonce)) {
+		return "", nil, errors.New("the nonce of the ID token doesn't match")
+	}
+
+	claims := &ssoClaims{}
+	err = idToken.Claims(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return sso.subject(idToken.Subject), claims, nil
+}
+
+// randomString returns a random URL safe string, used for the OAuth2 state
+// and the OIDC nonce.
+func randomString() (string, error) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+const testRedirectURL = "https://localhost:4000/user/login/sso/callback"
+
+// mockIdP is an OpenID Connect provider answering the discovery document,
+// the authorization and token endpoints and the signing keys, enough for the
+// authorization code flow with PKCE.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// pending authorizations by code: PKCE challenge and nonce
+	codes map[string][2]string
+	// claims of the next ID token, the standard ones are added
+	claims map[string]any
+	// when set, the ID token is signed with it instead of key
+	signWith *rsa.PrivateKey
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{key: key, codes: map[string][2]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/keys", idp.keys)
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/authorize",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// authorize log the user in at once and send them back with a code.
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if query.Get("response_type") != "code" || query.Get("client_id") != "snippetbox" ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	code := base64.RawURLEncoding.EncodeToString([]byte(query.Get("state")))
+
+	idp.mu.Lock()
+	idp.codes[code] = [2]string{query.Get("code_challenge"), query.Get("nonce")}
+	idp.mu.Unlock()
+
+	redirect, _ := url.Parse(query.Get("redirect_uri"))
+	redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != "snippetbox" || clientSecret != "secret" {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	idp.mu.Lock()
+	pending, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	// the verifier must hash to the challenge sent to the authorization
+	// endpoint
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != pending[0] {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := map[string]any{
+		"iss":   idp.URL,
+		"sub":   "248289761001",
+		"aud":   "snippetbox",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": pending[1],
+	}
+	idp.mu.Lock()
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	key := idp.key
+	if idp.signWith != nil {
+		key = idp.signWith
+	}
+	idp.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signJWT(key, claims),
+	})
+}
+
+func (idp *mockIdP) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *mockIdP) setClaims(claims map[string]any, signWith *rsa.PrivateKey) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	idp.claims = claims
+	idp.signWith = signWith
+}
+
+func signJWT(key *rsa.PrivateKey, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// ssoLoginFlow start a login with the ssoLogin handler, let the provider
+// authorize it and returns the code with the verifier and nonce the handler
+// kept in the session.
+func ssoLoginFlow(t *testing.T, app *application) (code, verifier, nonce string) {
+	ctx, err := app.sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	app.ssoLogin(rr, httptest.NewRequest(http.MethodGet, "/user/login/sso", nil).WithContext(ctx))
+
+	if rr.Code != http.StatusFound {
+		t.Fatalf("ssoLogin answered %d", rr.Code)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(callback.String(), testRedirectURL) {
+		t.Fatalf("authorization answered %d, redirect to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	if callback.Query().Get("state") != app.sessionManager.GetString(ctx, "ssoState") {
+		t.Fatal("the state came back changed")
+	}
+
+	return callback.Query().Get("code"), app.sessionManager.GetString(ctx, "ssoVerifier"), app.sessionManager.GetString(ctx, "ssoNonce")
+}
+
+func TestSSOExchange(t *testing.T) {
+	idp := newMockIdP(t)
+
+	// discovery
+	sso, err := newSSOProvider(context.Background(), idp.URL, "snippetbox", "secret", testRedirectURL, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{sso: sso, sessionManager: scs.New()}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string]any{"email": "alice@example.com", "email_verified": true, "name": "Alice"}
+
+	tests := []struct {
+		name     string
+		claims   map[string]any
+		signWith *rsa.PrivateKey
+		// change the values kept in the session by ssoLogin
+		verifier func(string) string
+		nonce    func(string) string
+		wantErr  bool
+	}{
+		{name: "valid", claims: valid},
+		{name: "wrong PKCE verifier", claims: valid, verifier: func(v string) string { return v + "x" }, wantErr: true},
+		{name: "missing PKCE verifier", claims: valid, verifier: func(string) string { return "" }, wantErr: true},
+		{name: "wrong nonce", claims: valid, nonce: func(n string) string { return n + "x" }, wantErr: true},
+		{name: "missing nonce", claims: valid, nonce: func(string) string { return "" }, wantErr: true},
+		{name: "signed with another key", claims: valid, signWith: otherKey, wantErr: true},
+		{name: "another audience", claims: map[string]any{"aud": "someone-else", "email": "alice@example.com"}, wantErr: true},
+		{name: "another issuer", claims: map[string]any{"iss": "https://evil.example.com", "email": "alice@example.com"}, wantErr: true},
+		{name: "expired", claims: map[string]any{"exp": time.Now().Add(-time.Hour).Unix(), "email": "alice@example.com"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.setClaims(tt.claims, tt.signWith)
+
+			code, verifier, nonce := ssoLoginFlow(t, app)
+			if tt.verifier != nil {
+				verifier = tt.verifier(verifier)
+			}
+			if tt.nonce != nil {
+				nonce = tt.nonce(nonce)
+			}
+
+			subject, claims, err := sso.exchange(context.Background(), code, verifier, nonce)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if subject != idp.URL+" 248289761001" {
+				t.Errorf("got subject %q", subject)
+			}
+			if claims.Email != "alice@example.com" || !claims.EmailVerified || claims.Name != "Alice" {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestSSOAllowedEmail(t *testing.T) {
+	sso := &ssoProvider{allowedDomains: []string{"example.com"}}
+
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"alice@example.com", true},
+		{"alice@EXAMPLE.com", true},
+		{"alice@evil.com", false},
+		{"alice@sub.example.com", false},
+		{"alice@example.com@evil.com", false},
+		{"alice", false},
+	}
+
+	for _, tt := range tests {
+		if got := sso.allowedEmail(tt.email); got != tt.want {
+			t.Errorf("allowedEmail(%q) = %t, want %t", tt.email, got, tt.want)
+		}
+	}
+
+	if !(&ssoProvider{}).allowedEmail("anyone@anywhere.org") {
+		t.Error("any email must be allowed without allowed domains")
+	}
+}
+
+func TestSSOAccount(t *testing.T) {
+	tests := []struct {
+		name     string
+		domains  []string
+		claims   ssoClaims
+		wantName string
+		wantOK   bool
+	}{
+		{"named", nil, ssoClaims{Email: "alice@example.com", EmailVerified: true, Name: "Alice"}, "Alice", true},
+		{"without name", nil, ssoClaims{Email: "alice@example.com", EmailVerified: true}, "alice", true},
+		{"unverified", nil, ssoClaims{Email: "alice@example.com", Name: "Alice"}, "", false},
+		{"without email", nil, ssoClaims{EmailVerified: true, Name: "Alice"}, "", false},
+		{"email without @", nil, ssoClaims{Email: "alice", EmailVerified: true}, "", false},
+		{"invalid email", nil, ssoClaims{Email: "alice@", EmailVerified: true}, "", false},
+		{"other domain", []string{"example.com"}, ssoClaims{Email: "alice@evil.com", EmailVerified: true}, "", false},
+		{"allowed domain", []string{"example.com"}, ssoClaims{Email: "alice@example.com", EmailVerified: true}, "alice", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sso := &ssoProvider{allowedDomains: tt.domains}
+
+			name, ok := sso.account(&tt.claims)
+			if name != tt.wantName || ok != tt.wantOK {
+				t.Errorf("got %q, %t, want %q, %t", name, ok, tt.wantName, tt.wantOK)
+			}
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/base64"
 	"html/template"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"snippetbox.kamanazan.net/internal/models"
@@ -14,11 +18,90 @@ import (
 // to it as the build progresses.
 // TODO: why not use map ?
 type templateData struct {
-	Snippet     *models.Snippet
-	Snippets    []*models.Snippet
-	CurrentYear int
-	FlashMsg    string
-	Form        any
+	Snippet         *models.Snippet
+	User            *models.Users
+	Snippets        []*models.Snippet
+	MostStarred     []*models.Snippet
+	Starred         bool
+	Collection      *models.Collection
+	Collections     []*models.Collection
+	IsOwner         bool
+	CanDelete       bool
+	TotalViews      int
+	DailyViews      []*models.DailyViews
+	Referrers       []*models.ReferrerViews
+	CurrentYear     int
+	FlashMsg        string
+	Form            any
+	IsAuthenticated bool
+	IsVerified      bool
+
+	TwoFactorAvailable bool
+	TOTPSecret         string
+	RecoveryCodes      []string
+	RecoveryCodesLeft  int
+
+	Credentials []*models.Credential
+
+	SSOEnabled bool
+
+	Sessions     []*models.UserSession
+	CurrentToken string
+
+	IsAdmin     bool
+	IsModerator bool
+	Reported    []*models.ReportedSnippet
+	AdminUsers  []*models.Users
+	Stats       *models.Stats
+	DBStats     sql.DBStats
+	Pagination  pagination
+	AuditEvents []*models.AuditEvent
+}
+
+// adminPageSize is the number of rows in the paginated admin tables.
+const adminPageSize = 25
+
+// pagination describe the current page of a table, Params are the search and
+// filters the rows are selected with.
+type pagination struct {
+	Path     string
+	Params   url.Values
+	Page     int
+	LastPage int
+}
+
+func newPagination(path string, params url.Values, page, total int) pagination {
+	lastPage := (total + adminPageSize - 1) / adminPageSize
+	if lastPage < 1 {
+		lastPage = 1
+	}
+	return pagination{Path: path, Params: params, Page: page, LastPage: lastPage}
+}
+
+func (p pagination) HasPrev() bool { return p.Page > 1 }
+func (p pagination) HasNext() bool { return p.Page < p.LastPage }
+func (p pagination) Prev() int     { return p.Page - 1 }
+func (p pagination) Next() int     { return p.Page + 1 }
+
+// URL returns the link to another page with the same search and filters.
+func (p pagination) URL(page int) string {
+	query := url.Values{}
+	for key, values := range p.Params {
+		if key != "page" && len(values) > 0 && values[0] != "" {
+			query.Set(key, values[0])
+		}
+	}
+	query.Set("page", strconv.Itoa(page))
+	return p.Path + "?" + query.Encode()
+}
+
+// base64url encode binary IDs (like passkey IDs) so they can be sent in forms.
+func base64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func shortDate(t time.Time) string {
+	return t.Format("02 Jan 2006")
 }
 
 func humanDate(t time.Time) string {
@@ -28,6 +111,8 @@ func humanDate(t time.Time) string {
 
 var funcTemplate = template.FuncMap{
 	"humanDate": humanDate,
+	"shortDate": shortDate,
+	"base64url": base64url,
 }
 
 func newTemplateCache() (map[string]*template.Template, error) {
@@ -84,5 +169,23 @@ func newTemplateCache() (map[string]*template.Template, error) {
 		cache[name] = ts
 	}
 
+	// Standalone pages (like the embeddable snippet) bring their own "base"
+	// template instead of the site layout, so they are parsed on their own.
+	standalone, err := filepath.Glob("./ui/html/standalone/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, page := range standalone {
+		name := filepath.Base(page)
+
+		ts, err := template.New(name).Funcs(funcTemplate).ParseFiles(page)
+		if err != nil {
+			return nil, err
+		}
+
+		cache[name] = ts
+	}
+
 	return cache, nil
 }
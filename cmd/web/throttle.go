@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"snippetbox.kamanazan.net/internal/mailer"
+	"snippetbox.kamanazan.net/internal/models"
+)
+
+// Login throttling policy. Once a key reach its threshold of failures in a
+// row, each new failure lock it twice as long, up to maxLoginLock. Clients get
+// a higher threshold since many users can share an IP behind a NAT.
+const (
+	accountFailureThreshold = 5
+	ipFailureThreshold      = 20
+	baseLoginLock           = time.Minute
+	maxLoginLock            = time.Hour
+)
+
+func accountThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// loginLock returns the lock duration after the given number of failures.
+func loginLock(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	lock := baseLoginLock
+	for i := threshold; i < failures && lock < maxLoginLock; i++ {
+		lock *= 2
+	}
+
+	if lock > maxLoginLock {
+		lock = maxLoginLock
+	}
+	return lock
+}
+
+// loginLockedFor returns how long logins to the account, or from the client,
+// are still refused.
+func (app *application) loginLockedFor(r *http.Request, email string) (time.Duration, error) {
+	return app.loginThrottle.LockedFor(accountThrottleKey(email), ipThrottleKey(r))
+}
+
+// loginFailed count a failed login against the account and the client and
+// lock them when they reach their threshold. The owner of the account is told
+// by email the first time it gets locked.
+func (app *application) loginFailed(r *http.Request, email string) error {
+	failures, err := app.loginThrottle.Fail(accountThrottleKey(email))
+	if err != nil {
+		return err
+	}
+
+	if lock := loginLock(failures, accountFailureThreshold); lock > 0 {
+		err = app.loginThrottle.Lock(accountThrottleKey(email), lock)
+		if err != nil {
+			return err
+		}
+
+		if failures == accountFailureThreshold {
+			err = app.sendLockoutMail(r, email, lock)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	failures, err = app.loginThrottle.Fail(ipThrottleKey(r))
+	if err != nil {
+		return err
+	}
+
+	if lock := loginLock(failures, ipFailureThreshold); lock > 0 {
+		return app.loginThrottle.Lock(ipThrottleKey(r), lock)
+	}
+
+	return nil
+}
+
+// loginSucceeded forget the failures of the account. The client counter is
+// kept, a valid account must not let a client try other accounts for free.
+func (app *application) loginSucceeded(email string) error {
+	return app.loginThrottle.Reset(accountThrottleKey(email))
+}
+
+func (app *application) sendLockoutMail(r *http.Request, email string, lock time.Duration) error {
+	user, err := app.user.GetByEmail(r.Context(), email)
+	if err != nil {
+		// nobody to tell about an email without account
+		if errors.Is(err, models.ErrNoRecord) {
+			return nil
+		}
+		return err
+	}
+
+	link := app.baseURL + "/user/password/forgot"
+
+	app.background(func() {
+		err := app.mailer.Send(mailer.Message{
+			To:      user.Email,
+			Subject: "Too many failed logins on your Snippetbox account",
+			Body: fmt.Sprintf("Hi %s,\n\nThere were %d failed attempts to log in to your account, logins are "+
+				"suspended for %s. If it wasn't you, someone may be guessing your password, consider "+
+				"changing it:\n\n%s\n", user.Name, accountFailureThreshold, lock, link),
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"time"
+
+	"snippetbox.kamanazan.net/internal/models"
+	"snippetbox.kamanazan.net/internal/totp"
+)
+
+var errNoEncryptionKey = errors.New("no encryption key configured")
+
+// encrypt seal plaintext with AES-GCM using the configured encryption key.
+// The random nonce is stored in front of the ciphertext.
+func (app *application) encrypt(plaintext []byte) ([]byte, error) {
+	if app.encryptionKey == nil {
+		return nil, errNoEncryptionKey
+	}
+
+	block, err := aes.NewCipher(app.encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (app *application) decrypt(ciphertext []byte) ([]byte, error) {
+	if app.encryptionKey == nil {
+		return nil, errNoEncryptionKey
+	}
+
+	block, err := aes.NewCipher(app.encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+// totpSecret returns the decrypted TOTP secret of the user, empty when the
+// user has none.
+func (app *application) totpSecret(ctx context.Context, userID int) (string, error) {
+	encrypted, err := app.user.TOTPSecret(ctx, userID)
+	if err != nil || encrypted == nil {
+		return "", err
+	}
+
+	secret, err := app.decrypt(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
+
+// checkTwoFactorCode accept either a code from the authenticator app or one
+// of the unused recovery codes of the user.
+func (app *application) checkTwoFactorCode(ctx context.Context, userID int, code string) (bool, error) {
+	secret, err := app.totpSecret(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	if secret != "" {
+		if step, ok := totp.Validate(secret, code, time.Now()); ok {
+			return app.user.UseTOTPStep(ctx, userID, step)
+		}
+	}
+
+	err = app.recoveryCode.Use(userID, code)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// generateRecoveryCodes returns n random codes formatted as XXXXX-XXXXX.
+func generateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+
+	for i := range codes {
+		random := make([]byte, 7)
+		_, err := rand.Read(random)
+		if err != nil {
+			return nil, err
+		}
+
+		code := base32.StdEncoding.EncodeToString(random)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	return codes, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"snippetbox.kamanazan.net/internal/models"
+)
+
+// How often the visitors of the previous days are deleted.
+const visitorPruneInterval = time.Hour
+
+// viewRecorder write snippet views to the database from a background
+// goroutine. Handlers only push to a buffered channel so a slow database never
+// delays the page, when the buffer is full the view is dropped.
+type viewRecorder struct {
+	views  chan models.View
+	model  *models.ViewModel
+	logger *slog.Logger
+	salt   string
+	done   chan struct{}
+
+	// closed is set by Close under the write lock, Record hold the read lock
+	// while sending so it never sends on the closed channel. Handlers can
+	// still be running when the shutdown timeout expire.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newViewRecorder(model *models.ViewModel, logger *slog.Logger, salt string, size int) *viewRecorder {
+	vr := &viewRecorder{
+		views:  make(chan models.View, size),
+		model:  model,
+		logger: logger,
+		salt:   salt,
+		done:   make(chan struct{}),
+	}
+
+	go vr.run()
+
+	return vr
+}
+
+func (vr *viewRecorder) run() {
+	defer close(vr.done)
+
+	ticker := time.NewTicker(visitorPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case v, ok := <-vr.views:
+			if !ok {
+				return
+			}
+			err := vr.model.Record(v)
+			if err != nil {
+				vr.logger.Error("recording view", "snippet", v.SnippetID, "error", err)
+			}
+		case now := <-ticker.C:
+			vr.prune(now)
+		}
+	}
+}
+
+// prune forget the visitors of the previous days, they are only needed to
+// count a visitor once a day. Yesterday is kept in case the clocks of the
+// application and of the database disagree about the date.
+func (vr *viewRecorder) prune(now time.Time) {
+	n, err := vr.model.DeleteVisitorsBefore(now.AddDate(0, 0, -1))
+	if err != nil {
+		vr.logger.Error("pruning view visitors", "error", err)
+		return
+	}
+	if n > 0 {
+		vr.logger.Debug("pruned view visitors", "count", n)
+	}
+}
+
+// Record queue a view of the snippet by the client making the request.
+func (vr *viewRecorder) Record(r *http.Request, snippetID int) {
+	now := time.Now()
+
+	v := models.View{
+		SnippetID: snippetID,
+		Visitor:   vr.visitor(r, now),
+		Referrer:  referrerHost(r),
+		Time:      now,
+	}
+
+	vr.mu.RLock()
+	defer vr.mu.RUnlock()
+
+	if vr.closed {
+		vr.logger.Warn("view recorder closed, dropping view", "snippet", snippetID)
+		return
+	}
+
+	select {
+	case vr.views <- v:
+	default:
+		vr.logger.Warn("view buffer full, dropping view", "snippet", snippetID)
+	}
+}
+
+// Close stop accepting views and wait until the queued ones are written. The
+// views recorded after it are dropped.
+func (vr *viewRecorder) Close() {
+	vr.mu.Lock()
+	if !vr.closed {
+		vr.closed = true
+		close(vr.views)
+	}
+	vr.mu.Unlock()
+
+	<-vr.done
+}
+
+// visitor identify the client for the day without storing its IP address: the
+// address is hashed together with a secret salt and the date, so the same
+// visitor get a different hash every day.
+func (vr *viewRecorder) visitor(r *http.Request, now time.Time) string {
+	sum := sha256.Sum256([]byte(vr.salt + "|" + now.Format("2006-01-02") + "|" + clientIP(r)))
+	return hex.EncodeToString(sum[:])
+}
+
+// referrerHost keep only the host of the Referer header, the full URL of the
+// referring page may contain private information.
+func referrerHost(r *http.Request) string {
+	ref, err := url.Parse(r.Referer())
+	if err != nil {
+		return ""
+	}
+
+	if len(ref.Host) > 255 {
+		return ref.Host[:255]
+	}
+	return ref.Host
+}
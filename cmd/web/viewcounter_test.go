@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"snippetbox.kamanazan.net/internal/models"
+)
+
+// TestViewRecorderClose record views while the recorder is closed, like
+// handlers still running after the shutdown timeout. None of them may send on
+// the closed channel.
+func TestViewRecorderClose(t *testing.T) {
+	vr := &viewRecorder{
+		views:  make(chan models.View, 1024),
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		done:   make(chan struct{}),
+	}
+
+	// stand in for run, without database
+	go func() {
+		defer close(vr.done)
+		for range vr.views {
+		}
+	}()
+
+	r := httptest.NewRequest(http.MethodGet, "/snippet/view/1", nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				vr.Record(r, 1)
+			}
+		}()
+	}
+
+	vr.Close()
+	wg.Wait()
+
+	// late views and a second Close are harmless
+	vr.Record(r, 1)
+	vr.Close()
+}
@@ -0,0 +1,75 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer send emails on behalf of the application. Handlers only depend on
+// this interface so the delivery method can be chosen at startup.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// SMTPMailer deliver messages through an SMTP server. Username and Password
+// are optional, when set PLAIN authentication is used.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, m.format(msg))
+}
+
+func (m *SMTPMailer) format(msg Message) []byte {
+	var b strings.Builder
+
+	// header values must not contain line breaks or they could inject headers
+	clean := strings.NewReplacer("\r", "", "\n", "")
+
+	fmt.Fprintf(&b, "From: %s\r\n", clean.Replace(m.From))
+	fmt.Fprintf(&b, "To: %s\r\n", clean.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", clean.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
+
+// LogMailer doesn't deliver anything, it write the messages to a logger
+// instead. It is meant for local development and tests, point the logger to a
+// file to keep the messages around.
+type LogMailer struct {
+	Logger *slog.Logger
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	m.Logger.Info("mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
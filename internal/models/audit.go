@@ -0,0 +1,155 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEvent is an entry of the audit log. ActorID is 0 for anonymous
+// actions, e.g. a failed login or a command line tool.
+type AuditEvent struct {
+	ID         int64
+	Created    time.Time
+	ActorID    int
+	ActorEmail string
+	Action     string
+	IP         string
+	UserAgent  string
+	Target     string
+	Details    json.RawMessage
+}
+
+// AuditFilter select the events shown in the audit log, empty fields don't
+// filter anything. Action also match every action starting with it followed
+// by a dot, e.g. "admin" match "admin.user_disable".
+type AuditFilter struct {
+	Action string
+	Actor  string
+	Target string
+	From   time.Time
+	To     time.Time
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// Insert append an event to the log.
+func (m *AuditModel) Insert(e *AuditEvent) error {
+	if len(e.UserAgent) > 512 {
+		e.UserAgent = e.UserAgent[:512]
+	}
+
+	details := e.Details
+	if details == nil {
+		details = json.RawMessage("{}")
+	}
+
+	stmt := `
+	INSERT INTO audit_events (created, actor_id, actor_email, action, ip, user_agent, target, details)
+	VALUES (localtimestamp, NULLIF($1, 0), $2, $3, $4, $5, $6, $7);
+	`
+
+	_, err := m.DB.Exec(stmt, e.ActorID, e.ActorEmail, e.Action, e.IP, e.UserAgent, e.Target, []byte(details))
+	return err
+}
+
+// where build the WHERE clause of the filter and its arguments.
+func (f AuditFilter) where() (string, []any) {
+	var conditions []string
+	var args []any
+
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.Action != "" {
+		add("(action = $%[1]d OR starts_with(action, $%[1]d || '.'))", f.Action)
+	}
+	if f.Actor != "" {
+		add("actor_email ILIKE $%d", "%"+escapeLike(f.Actor)+"%")
+	}
+	if f.Target != "" {
+		add("target = $%d", f.Target)
+	}
+	// created is a local timestamp, compare it with the wall clock time
+	if !f.From.IsZero() {
+		add("created >= $%d::TIMESTAMP", f.From.Format("2006-01-02 15:04:05"))
+	}
+	if !f.To.IsZero() {
+		add("created < $%d::TIMESTAMP", f.To.Format("2006-01-02 15:04:05"))
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// List returns a page of the events matching the filter, newest first, and
+// the number of matching events.
+func (m *AuditModel) List(filter AuditFilter, limit, offset int) ([]*AuditEvent, int, error) {
+	where, args := filter.where()
+
+	var total int
+	err := m.DB.QueryRow(`SELECT count(*) FROM audit_events `+where+`;`, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	events := []*AuditEvent{}
+
+	stmt := fmt.Sprintf(`SELECT %s FROM audit_events %s ORDER BY id DESC LIMIT $%d OFFSET $%d;`,
+		auditColumns, where, len(args)+1, len(args)+2)
+
+	err = m.each(stmt, append(args, limit, offset), func(e *AuditEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
+
+// Each call fn for every event matching the filter, oldest first, without
+// loading them all in memory.
+func (m *AuditModel) Each(filter AuditFilter, fn func(*AuditEvent) error) error {
+	where, args := filter.where()
+
+	stmt := `SELECT ` + auditColumns + ` FROM audit_events ` + where + ` ORDER BY id;`
+
+	return m.each(stmt, args, fn)
+}
+
+const auditColumns = `id, created, COALESCE(actor_id, 0), actor_email, action, ip, user_agent, target, details`
+
+func (m *AuditModel) each(stmt string, args []any, fn func(*AuditEvent) error) error {
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &AuditEvent{}
+		var details []byte
+		err := rows.Scan(&e.ID, &e.Created, &e.ActorID, &e.ActorEmail, &e.Action, &e.IP, &e.UserAgent, &e.Target, &details)
+		if err != nil {
+			return err
+		}
+		e.Details = details
+
+		err = fn(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type Collection struct {
+	ID          int
+	UserID      int
+	Name        string
+	Slug        string
+	Description string
+	Visibility  string
+	Created     time.Time
+}
+
+// Ref is how the collection is named in URLs: the ID, which is unique, and
+// the slug for readability, e.g. "12-start-here".
+func (c *Collection) Ref() string {
+	return strconv.Itoa(c.ID) + "-" + c.Slug
+}
+
+// IsPublic reports whether anyone, not only the owner, can see the collection.
+func (c *Collection) IsPublic() bool {
+	return c.Visibility == "public"
+}
+
+type CollectionModel struct {
+	DB *sql.DB
+}
+
+func (m *CollectionModel) Insert(userID int, name, slug, description, visibility string) (int, error) {
+	stmt := `
+	INSERT INTO collection (user_id, name, slug, description, visibility, created)
+	VALUES ($1, $2, $3, $4, $5, localtimestamp) RETURNING id;
+	`
+
+	var id int
+	err := m.DB.QueryRow(stmt, userID, name, slug, description, visibility).Scan(&id)
+	if err != nil {
+		var pgErr *pq.Error
+		if errors.As(err, &pgErr) && strings.Contains(pgErr.Message, "collection_user_slug_key") {
+			return 0, ErrDuplicateSlug
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Update change the details of a collection, the slug is kept as is so links
+// shared before the rename stay the same.
+func (m *CollectionModel) Update(id int, name, description, visibility string) error {
+	stmt := `UPDATE collection SET name = $2, description = $3, visibility = $4 WHERE id = $1;`
+
+	_, err := m.DB.Exec(stmt, id, name, description, visibility)
+	return err
+}
+
+func (m *CollectionModel) Delete(id int) error {
+	_, err := m.DB.Exec(`DELETE FROM collection WHERE id = $1;`, id)
+	return err
+}
+
+func (m *CollectionModel) Get(id int) (*Collection, error) {
+	stmt := `
+	SELECT id, user_id, name, slug, description, visibility, created FROM collection
+	WHERE id = $1;
+	`
+
+	c := &Collection{}
+
+	err := m.DB.QueryRow(stmt, id).Scan(&c.ID, &c.UserID, &c.Name, &c.Slug, &c.Description, &c.Visibility, &c.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (m *CollectionModel) ByUser(userID int) ([]*Collection, error) {
+	stmt := `
+	SELECT id, user_id, name, slug, description, visibility, created FROM collection
+	WHERE user_id = $1
+	ORDER BY name;
+	`
+
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := []*Collection{}
+
+	for rows.Next() {
+		c := &Collection{}
+		err := rows.Scan(&c.ID, &c.UserID, &c.Name, &c.Slug, &c.Description, &c.Visibility, &c.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		collections = append(collections, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+// AddSnippet append the snippet at the end of the collection. Adding a snippet
+// which is already in the collection does nothing.
+func (m *CollectionModel) AddSnippet(collectionID, snippetID int) error {
+	stmt := `
+	INSERT INTO collection_snippet (collection_id, snippet_id, position)
+	SELECT $1, $2, COALESCE(MAX(position), 0) + 1 FROM collection_snippet WHERE collection_id = $1
+	ON CONFLICT (collection_id, snippet_id) DO NOTHING;
+	`
+
+	_, err := m.DB.Exec(stmt, collectionID, snippetID)
+	return err
+}
+
+func (m *CollectionModel) RemoveSnippet(collectionID, snippetID int) error {
+	stmt := `DELETE FROM collection_snippet WHERE collection_id = $1 AND snippet_id = $2;`
+
+	_, err := m.DB.Exec(stmt, collectionID, snippetID)
+	return err
+}
+
+// Reorder set the position of the snippets to their index in snippetIDs. It
+// run in a transaction so the collection is never left half ordered, IDs which
+// are not part of the collection are ignored.
+func (m *CollectionModel) Reorder(collectionID int, snippetIDs []int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `UPDATE collection_snippet SET position = $3 WHERE collection_id = $1 AND snippet_id = $2;`
+
+	for i, snippetID := range snippetIDs {
+		_, err = tx.Exec(stmt, collectionID, snippetID, i+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
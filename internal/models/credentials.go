@@ -0,0 +1,96 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Credential is a passkey registered by a user. Data is the credential as
+// encoded by the WebAuthn layer, the model doesn't need to understand it.
+type Credential struct {
+	ID       []byte
+	UserID   int
+	Name     string
+	Data     []byte
+	Created  time.Time
+	LastUsed sql.NullTime
+}
+
+type CredentialModel struct {
+	DB *sql.DB
+}
+
+func (m *CredentialModel) Insert(userID int, id []byte, name string, data []byte) error {
+	stmt := `
+	INSERT INTO credentials (id, user_id, name, data, created)
+	VALUES ($1, $2, $3, $4, localtimestamp);
+	`
+
+	_, err := m.DB.Exec(stmt, id, userID, name, data)
+	return err
+}
+
+func (m *CredentialModel) Get(id []byte) (*Credential, error) {
+	stmt := `SELECT id, user_id, name, data, created, last_used FROM credentials WHERE id = $1;`
+
+	c := &Credential{}
+
+	err := m.DB.QueryRow(stmt, id).Scan(&c.ID, &c.UserID, &c.Name, &c.Data, &c.Created, &c.LastUsed)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (m *CredentialModel) ByUser(userID int) ([]*Credential, error) {
+	stmt := `
+	SELECT id, user_id, name, data, created, last_used FROM credentials
+	WHERE user_id = $1
+	ORDER BY created;
+	`
+
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []*Credential{}
+
+	for rows.Next() {
+		c := &Credential{}
+		err := rows.Scan(&c.ID, &c.UserID, &c.Name, &c.Data, &c.Created, &c.LastUsed)
+		if err != nil {
+			return nil, err
+		}
+
+		credentials = append(credentials, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// Used store the credential data after a successful login (the sign counter
+// changes) and record when it happened.
+func (m *CredentialModel) Used(id []byte, data []byte) error {
+	stmt := `UPDATE credentials SET data = $2, last_used = localtimestamp WHERE id = $1;`
+
+	_, err := m.DB.Exec(stmt, id, data)
+	return err
+}
+
+// Delete remove a credential, only if it belongs to the user.
+func (m *CredentialModel) Delete(userID int, id []byte) error {
+	stmt := `DELETE FROM credentials WHERE user_id = $1 AND id = $2;`
+
+	_, err := m.DB.Exec(stmt, userID, id)
+	return err
+}
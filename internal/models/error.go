@@ -12,4 +12,19 @@ var (
 	// Add a new ErrDuplicateEmail error. We'll use this later if a user
 	// tries to signup with an email address that's already in use.
 	ErrDuplicateEmail = errors.New("models: duplicate email")
+
+	// ErrDuplicateSlug is returned when a collection name produce a slug that
+	// is already used by another collection.
+	ErrDuplicateSlug = errors.New("models: duplicate slug")
+
+	// ErrUnverifiedEmail is returned when an SSO identity would be linked to
+	// an account whose email was never verified.
+	ErrUnverifiedEmail = errors.New("models: unverified email")
+
+	// ErrAccountDisabled is returned when the right password is given for an
+	// account disabled by an admin.
+	ErrAccountDisabled = errors.New("models: account disabled")
+
+	// ErrDuplicateReport is returned when a user report the same snippet twice.
+	ErrDuplicateReport = errors.New("models: duplicate report")
 )
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LoginThrottleModel count the failed logins per key, the policy deciding how
+// long a key is locked is left to the caller.
+type LoginThrottleModel struct {
+	DB *sql.DB
+}
+
+// Fail record a failed login for the key and returns the number of failures
+// in a row. A key without failure for a day start again from zero.
+func (m *LoginThrottleModel) Fail(key string) (int, error) {
+	stmt := `
+	INSERT INTO login_throttle (key, failures, last_failure) VALUES ($1, 1, localtimestamp)
+	ON CONFLICT (key) DO UPDATE SET
+		failures = CASE
+			WHEN login_throttle.last_failure < localtimestamp - INTERVAL '1 DAY' THEN 1
+			ELSE login_throttle.failures + 1
+		END,
+		last_failure = localtimestamp
+	RETURNING failures;
+	`
+
+	var failures int
+	err := m.DB.QueryRow(stmt, key).Scan(&failures)
+	return failures, err
+}
+
+// Lock refuse any login for the key during d.
+func (m *LoginThrottleModel) Lock(key string, d time.Duration) error {
+	stmt := `
+	UPDATE login_throttle SET locked_until = localtimestamp + ($2 || ' SECONDS')::INTERVAL
+	WHERE key = $1;
+	`
+
+	_, err := m.DB.Exec(stmt, key, int(d.Seconds()))
+	return err
+}
+
+// LockedFor returns how long the most restricted of the keys is still locked,
+// zero when a login can be attempted.
+func (m *LoginThrottleModel) LockedFor(keys ...string) (time.Duration, error) {
+	stmt := `
+	SELECT COALESCE(EXTRACT(EPOCH FROM MAX(locked_until) - localtimestamp), 0)
+	FROM login_throttle
+	WHERE key = ANY($1) AND locked_until > localtimestamp;
+	`
+
+	var seconds float64
+	err := m.DB.QueryRow(stmt, pq.Array(keys)).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Reset forget the failures of the key after a successful login.
+func (m *LoginThrottleModel) Reset(key string) error {
+	stmt := `DELETE FROM login_throttle WHERE key = $1;`
+
+	_, err := m.DB.Exec(stmt, key)
+	return err
+}
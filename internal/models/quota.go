@@ -0,0 +1,44 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// QuotaModel count actions per key in fixed windows, e.g. the snippets created
+// by a user in an hour.
+type QuotaModel struct {
+	DB *sql.DB
+}
+
+// Take count one more action for the key in the current window. It returns
+// zero when the action is within the limit, otherwise how long until the
+// window ends.
+func (m *QuotaModel) Take(key string, limit int, window time.Duration) (time.Duration, error) {
+	stmt := `
+	INSERT INTO quotas (key, window_start, used) VALUES ($1, localtimestamp, 1)
+	ON CONFLICT (key) DO UPDATE SET
+		window_start = CASE
+			WHEN quotas.window_start <= localtimestamp - ($2 || ' SECONDS')::INTERVAL THEN localtimestamp
+			ELSE quotas.window_start
+		END,
+		used = CASE
+			WHEN quotas.window_start <= localtimestamp - ($2 || ' SECONDS')::INTERVAL THEN 1
+			ELSE quotas.used + 1
+		END
+	RETURNING used, EXTRACT(EPOCH FROM window_start + ($2 || ' SECONDS')::INTERVAL - localtimestamp);
+	`
+
+	var used int
+	var seconds float64
+	err := m.DB.QueryRow(stmt, key, int(window.Seconds())).Scan(&used, &seconds)
+	if err != nil {
+		return 0, err
+	}
+
+	if used <= limit {
+		return 0, nil
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
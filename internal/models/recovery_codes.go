@@ -0,0 +1,78 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// RecoveryCodeModel store the one-time codes a user can use instead of a TOTP
+// code when they lose their authenticator. Like tokens, only hashes are kept.
+type RecoveryCodeModel struct {
+	DB *sql.DB
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Replace delete every recovery code of the user and store the new ones.
+func (m *RecoveryCodeModel) Replace(userID int, codes []string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1;`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		_, err = tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2);`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Use mark an unused recovery code as used. It returns ErrNoRecord when the
+// code is unknown or was already used.
+func (m *RecoveryCodeModel) Use(userID int, code string) error {
+	stmt := `
+	UPDATE recovery_codes SET used = localtimestamp
+	WHERE user_id = $1 AND code_hash = $2 AND used IS NULL
+	RETURNING user_id;
+	`
+
+	err := m.DB.QueryRow(stmt, userID, hashRecoveryCode(code)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m *RecoveryCodeModel) Remaining(userID int) (int, error) {
+	var count int
+
+	stmt := `SELECT count(*) FROM recovery_codes WHERE user_id = $1 AND used IS NULL;`
+
+	err := m.DB.QueryRow(stmt, userID).Scan(&count)
+	return count, err
+}
+
+func (m *RecoveryCodeModel) DeleteAll(userID int) error {
+	_, err := m.DB.Exec(`DELETE FROM recovery_codes WHERE user_id = $1;`, userID)
+	return err
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := hashRecoveryCode("ABCDE-12345")
+
+	for _, code := range []string{"ABCDE-12345", "abcde-12345", "ABCDE12345", " abcde12345 "} {
+		if got := hashRecoveryCode(code); got != want {
+			t.Errorf("%q doesn't hash like ABCDE-12345", code)
+		}
+	}
+
+	if hashRecoveryCode("ABCDE-12346") == want {
+		t.Error("different codes have the same hash")
+	}
+}
+
+func TestRecoveryCodeUse(t *testing.T) {
+	db := newTestDB(t)
+	m := &RecoveryCodeModel{DB: db}
+
+	alice := insertTestUser(t, db, "alice@example.com")
+	bob := insertTestUser(t, db, "bob@example.com")
+
+	err := m.Replace(alice, []string{"AAAAA-11111", "BBBBB-22222"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the code of another user
+	err = m.Use(bob, "AAAAA-11111")
+	if !errors.Is(err, ErrNoRecord) {
+		t.Errorf("using the code of another user: got %v, want ErrNoRecord", err)
+	}
+
+	// codes are accepted however they are typed
+	err = m.Use(alice, "aaaaa11111")
+	if err != nil {
+		t.Fatalf("first use: %s", err)
+	}
+
+	err = m.Use(alice, "AAAAA-11111")
+	if !errors.Is(err, ErrNoRecord) {
+		t.Errorf("second use: got %v, want ErrNoRecord", err)
+	}
+
+	remaining, err := m.Remaining(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 1 {
+		t.Errorf("got %d remaining codes, want 1", remaining)
+	}
+
+	// new codes replace the old ones, used or not
+	err = m.Replace(alice, []string{"CCCCC-33333"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Use(alice, "BBBBB-22222")
+	if !errors.Is(err, ErrNoRecord) {
+		t.Errorf("replaced code: got %v, want ErrNoRecord", err)
+	}
+
+	err = m.Use(alice, "CCCCC-33333")
+	if err != nil {
+		t.Errorf("new code: %s", err)
+	}
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Report statuses, a report is open until a moderator resolve it.
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportHidden    = "hidden"
+	ReportDeleted   = "deleted"
+)
+
+type Report struct {
+	ID           int
+	SnippetID    int
+	SnippetTitle string
+	ReporterID   int
+	ReporterName string
+	Reason       string
+	Created      time.Time
+	Status       string
+	// filed by the content policy rather than a user
+	Automatic bool
+}
+
+// ReportedSnippet is an entry of the moderation queue: a snippet with all its
+// open reports.
+type ReportedSnippet struct {
+	Snippet *Snippet
+	Reports []*Report
+}
+
+type ReportModel struct {
+	DB *sql.DB
+}
+
+// Insert record a report and returns the number of distinct users with an
+// open report on the snippet. It returns ErrDuplicateReport when the user
+// already reported the snippet.
+func (m *ReportModel) Insert(snippetID, reporterID int, reason string) (int, error) {
+	stmt := `
+	INSERT INTO reports (snippet_id, snippet_title, reporter_id, reason, created)
+	SELECT id, title, $2, $3, localtimestamp FROM snippet WHERE id = $1;
+	`
+
+	_, err := m.DB.Exec(stmt, snippetID, reporterID, reason)
+	if err != nil {
+		var pgErr *pq.Error
+		if errors.As(err, &pgErr) && strings.Contains(pgErr.Message, "reports_open_idx") {
+			return 0, ErrDuplicateReport
+		}
+		return 0, err
+	}
+
+	stmt = `SELECT count(DISTINCT reporter_id) FROM reports WHERE snippet_id = $1 AND status = 'open';`
+
+	var reporters int
+	err = m.DB.QueryRow(stmt, snippetID).Scan(&reporters)
+	return reporters, err
+}
+
+// Queue returns the snippets with open reports, the most reported first.
+func (m *ReportModel) Queue() ([]*ReportedSnippet, error) {
+	stmt := `
+	SELECT r.id, r.snippet_id, r.snippet_title, COALESCE(r.reporter_id, 0), COALESCE(u.name, ''),
+		r.reason, r.created, r.status, r.automatic,
+		` + snippetColumns + `
+	FROM reports r
+	JOIN snippet ON snippet.id = r.snippet_id
+	LEFT JOIN users u ON u.id = r.reporter_id
+	WHERE r.status = 'open'
+	ORDER BY (SELECT count(*) FROM reports o WHERE o.snippet_id = r.snippet_id AND o.status = 'open') DESC,
+		r.snippet_id, r.created;
+	`
+
+	rows, err := m.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queue := []*ReportedSnippet{}
+
+	for rows.Next() {
+		r := &Report{}
+		s := &Snippet{}
+		err := rows.Scan(&r.ID, &r.SnippetID, &r.SnippetTitle, &r.ReporterID, &r.ReporterName, &r.Reason, &r.Created, &r.Status, &r.Automatic,
+			&s.ID, &s.Title, &s.Content, &s.Created, &s.Expired, &s.Stars, &s.UserID, &s.Hidden)
+		if err != nil {
+			return nil, err
+		}
+
+		// rows are sorted by snippet, a new snippet start a new entry
+		if len(queue) == 0 || queue[len(queue)-1].Snippet.ID != s.ID {
+			queue = append(queue, &ReportedSnippet{Snippet: s})
+		}
+		entry := queue[len(queue)-1]
+		entry.Reports = append(entry.Reports, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+// Resolve close every open report of the snippet with the moderator decision.
+func (m *ReportModel) Resolve(snippetID, moderatorID int, status string) error {
+	stmt := `
+	UPDATE reports SET status = $3, resolved_by = $2, resolved_at = localtimestamp
+	WHERE snippet_id = $1 AND status = 'open';
+	`
+
+	_, err := m.DB.Exec(stmt, snippetID, moderatorID, status)
+	return err
+}
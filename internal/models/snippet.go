@@ -1,8 +1,10 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 )
 
@@ -12,38 +14,85 @@ type Snippet struct {
 	Content string
 	Created time.Time
 	Expired time.Time
+	Stars   int
+	// UserID is the owner of the snippet, 0 for snippets created anonymously.
+	UserID int
+	// Hidden snippets were hidden by moderation, they are only visible in the
+	// moderation queue.
+	Hidden bool
 }
 
 type SnippetModel struct {
 	DB *sql.DB
 }
 
-func (m *SnippetModel) Insert(title, content string, expired int) (int, error) {
+// snippetColumns is the column list shared by every query returning a Snippet,
+// the star count is computed from the snippet_star join table.
+const snippetColumns = `snippet.id, snippet.title, snippet.content, snippet.created, snippet.expired,
+    (SELECT count(*) FROM snippet_star WHERE snippet_star.snippet_id = snippet.id), COALESCE(snippet.user_id, 0),
+    snippet.hidden_at IS NOT NULL`
+
+// Insert a new snippet, userID is the owner of the snippet or 0 when it is
+// created anonymously.
+func (m *SnippetModel) Insert(ctx context.Context, title, content string, expired, userID int) (_ int, err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.Insert")
+	defer func() { endSpan(span, err) }()
+
 	// Parameter placeholders in prepared statements vary depending on the DBMS and driver you’re using.
 	// For example, the pq driver for Postgres requires a placeholder like $1 instead of ?.
 
 	// sql standard require the interval value inside a quote (e.g IINTERVAL '7 DAYS') which make argument for the prepared statement ignored
 	// so we concat it and cast it as interval
-	stmt := `INSERT INTO snippet (title, content, created, expired) 
-             VALUES ($1, $2, localtimestamp, (localtimestamp + ($3 || ' DAYS')::INTERVAL)) RETURNING id;`
+	stmt := `INSERT INTO snippet (title, content, created, expired, user_id) 
+             VALUES ($1, $2, localtimestamp, (localtimestamp + ($3 || ' DAYS')::INTERVAL), NULLIF($4, 0)) RETURNING id;`
 
 	var id int
-	err := m.DB.QueryRow(stmt, title, content, expired).Scan(&id)
+	err = m.DB.QueryRowContext(ctx, stmt, title, content, expired, userID).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
 	return int(id), nil
 }
 
-func (m *SnippetModel) Get(id int) (*Snippet, error) {
+// InsertQuarantined create a snippet hidden from the start, with an
+// automatic report giving the reason to the moderators. The snippet and its
+// report are inserted by the same statement, a quarantined snippet is never
+// visible nor left without report.
+func (m *SnippetModel) InsertQuarantined(ctx context.Context, title, content string, expired, userID int, reason string) (_ int, err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.InsertQuarantined")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `
+	WITH s AS (
+		INSERT INTO snippet (title, content, created, expired, user_id, hidden_at)
+		VALUES ($1, $2, localtimestamp, (localtimestamp + ($3 || ' DAYS')::INTERVAL), NULLIF($4, 0), localtimestamp)
+		RETURNING id, title
+	)
+	INSERT INTO reports (snippet_id, snippet_title, reason, automatic, created)
+	SELECT id, title, $5, true, localtimestamp FROM s
+	RETURNING snippet_id;
+	`
+
+	var id int
+	err = m.DB.QueryRowContext(ctx, stmt, title, content, expired, userID, reason).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (m *SnippetModel) Get(ctx context.Context, id int) (_ *Snippet, err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.Get")
+	defer func() { endSpan(span, err) }()
+
 	stmt := `
-    SELECT id, title, content, created, expired FROM snippet
-    WHERE expired > localtimestamp and id = $1;
+    SELECT ` + snippetColumns + ` FROM snippet
+    WHERE expired > localtimestamp AND hidden_at IS NULL AND id = $1;
     `
 
 	s := &Snippet{}
 
-	err := m.DB.QueryRow(stmt, id).Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expired)
+	err = m.DB.QueryRowContext(ctx, stmt, id).Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expired, &s.Stars, &s.UserID, &s.Hidden)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -56,32 +105,168 @@ func (m *SnippetModel) Get(id int) (*Snippet, error) {
 	return s, nil
 }
 
-func (m *SnippetModel) Latest() ([]*Snippet, error) {
+// Delete remove the snippet along with its stars, views and collection
+// entries.
+func (m *SnippetModel) Delete(ctx context.Context, id int) (err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.Delete")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `DELETE FROM snippet WHERE id = $1;`
+
+	_, err = m.DB.ExecContext(ctx, stmt, id)
+	return err
+}
+
+// Expire make the snippet expire now, it disappear from the site but is kept
+// in the database.
+func (m *SnippetModel) Expire(ctx context.Context, id int) (err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.Expire")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `UPDATE snippet SET expired = localtimestamp WHERE id = $1 AND expired > localtimestamp;`
+
+	_, err = m.DB.ExecContext(ctx, stmt, id)
+	return err
+}
+
+// Search returns a page of snippets, expired ones included, whose title or
+// content contains the search, and the number of matching snippets.
+func (m *SnippetModel) Search(ctx context.Context, search string, limit, offset int) (_ []*Snippet, _ int, err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.Search")
+	defer func() { endSpan(span, err) }()
+
+	pattern := "%" + escapeLike(search) + "%"
+
+	var total int
+	err = m.DB.QueryRowContext(ctx, `SELECT count(*) FROM snippet WHERE title ILIKE $1 OR content ILIKE $1;`, pattern).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stmt := `
+    SELECT ` + snippetColumns + ` FROM snippet
+    WHERE title ILIKE $1 OR content ILIKE $1
+    ORDER BY id DESC LIMIT $2 OFFSET $3;
+    `
+
+	snippets, err := m.query(ctx, stmt, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return snippets, total, nil
+}
+
+// SetHidden hide the snippet from everyone during moderation, or show it
+// again.
+func (m *SnippetModel) SetHidden(ctx context.Context, id int, hidden bool) (err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.SetHidden")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `UPDATE snippet SET hidden_at = CASE WHEN $2 THEN localtimestamp END WHERE id = $1;`
+
+	_, err = m.DB.ExecContext(ctx, stmt, id, hidden)
+	return err
+}
+
+func (m *SnippetModel) Latest(ctx context.Context) (_ []*Snippet, err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.Latest")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `
+    SELECT ` + snippetColumns + ` FROM snippet
+    WHERE expired > localtimestamp AND hidden_at IS NULL
+    ORDER BY id DESC
+    LIMIT 10;
+    `
+
+	return m.query(ctx, stmt)
+}
+
+// LatestByUser returns the 10 most recent unexpired snippets of a user.
+func (m *SnippetModel) LatestByUser(ctx context.Context, userID int) (_ []*Snippet, err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.LatestByUser")
+	defer func() { endSpan(span, err) }()
+
 	stmt := `
-    SELECT id, title, content, created, expired FROM snippet
-    WHERE expired > localtimestamp
+    SELECT ` + snippetColumns + ` FROM snippet
+    WHERE expired > localtimestamp AND hidden_at IS NULL AND user_id = $1
     ORDER BY id DESC
     LIMIT 10;
     `
 
+	return m.query(ctx, stmt, userID)
+}
+
+// MostStarred returns the snippets which received the most stars during the
+// last `days` days. Snippets without any star in that window are left out.
+func (m *SnippetModel) MostStarred(ctx context.Context, days int) (_ []*Snippet, err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.MostStarred")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `
+    SELECT ` + snippetColumns + ` FROM snippet
+    JOIN snippet_star recent ON recent.snippet_id = snippet.id
+    WHERE snippet.expired > localtimestamp AND snippet.hidden_at IS NULL
+    AND recent.created > (localtimestamp - ($1 || ' DAYS')::INTERVAL)
+    GROUP BY snippet.id
+    ORDER BY count(recent.user_id) DESC, snippet.id DESC
+    LIMIT 5;
+    `
+
+	return m.query(ctx, stmt, days)
+}
+
+// StarredBy returns every unexpired snippet starred by the user, most recently
+// starred first.
+func (m *SnippetModel) StarredBy(ctx context.Context, userID int) (_ []*Snippet, err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.StarredBy")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `
+    SELECT ` + snippetColumns + ` FROM snippet
+    JOIN snippet_star mine ON mine.snippet_id = snippet.id
+    WHERE snippet.expired > localtimestamp AND snippet.hidden_at IS NULL AND mine.user_id = $1
+    ORDER BY mine.created DESC;
+    `
+
+	return m.query(ctx, stmt, userID)
+}
+
+// InCollection returns the unexpired snippets of a collection in the order
+// chosen by the collection owner.
+func (m *SnippetModel) InCollection(ctx context.Context, collectionID int) (_ []*Snippet, err error) {
+	ctx, span := startSpan(ctx, "SnippetModel.InCollection")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `
+    SELECT ` + snippetColumns + ` FROM snippet
+    JOIN collection_snippet member ON member.snippet_id = snippet.id
+    WHERE snippet.expired > localtimestamp AND snippet.hidden_at IS NULL AND member.collection_id = $1
+    ORDER BY member.position;
+    `
+
+	return m.query(ctx, stmt, collectionID)
+}
+
+func (m *SnippetModel) query(ctx context.Context, stmt string, args ...any) ([]*Snippet, error) {
 	snippets := []*Snippet{} // kenapa pake '*' ?
 
-	rows, err := m.DB.Query(stmt)
-	defer rows.Close()
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
 	if err != nil {
 		return nil, err
 	}
 
 	// We defer rows.Close() to ensure the sql.Rows resultset is
-	// always properly closed before the Latest() method returns. This defer
+	// always properly closed before the method returns. This defer
 	// statement should come *after* you check for an error from the Query()
 	// method. Otherwise, if Query() returns an error, you'll get a panic
 	// trying to close a nil resultset.
-	// defer rows.Close()
+	defer rows.Close()
 
 	for rows.Next() {
 		s := &Snippet{} // kenapa pake '&' ?
-		err := rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expired)
+		err := rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expired, &s.Stars, &s.UserID, &s.Hidden)
 		if err != nil {
 			return nil, err
 		}
@@ -94,3 +279,9 @@ func (m *SnippetModel) Latest() ([]*Snippet, error) {
 	}
 	return snippets, nil
 }
+
+// escapeLike escape the wildcards of a LIKE pattern so the search is matched
+// literally.
+func escapeLike(search string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(search)
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSnippetInsertQuarantined(t *testing.T) {
+	db := newTestDB(t)
+	m := &SnippetModel{DB: db}
+	reports := &ReportModel{DB: db}
+	ctx := context.Background()
+
+	userID := insertTestUser(t, db, "spammer@example.com")
+
+	// anonymous snippets are quarantined too
+	for _, owner := range []int{userID, 0} {
+		id, err := m.InsertQuarantined(ctx, "Cheap watches", "buy now", 7, owner, "Spam score 6.0: blocked terms: watches")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = m.Get(ctx, id)
+		if !errors.Is(err, ErrNoRecord) {
+			t.Errorf("snippet %d is visible: %v", id, err)
+		}
+	}
+
+	queue, err := reports.Queue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queue) != 2 {
+		t.Fatalf("got %d snippets in the queue, want 2", len(queue))
+	}
+	for _, reported := range queue {
+		if !reported.Snippet.Hidden {
+			t.Errorf("snippet %d is not hidden", reported.Snippet.ID)
+		}
+		if len(reported.Reports) != 1 {
+			t.Fatalf("snippet %d has %d reports, want 1", reported.Snippet.ID, len(reported.Reports))
+		}
+		if r := reported.Reports[0]; !r.Automatic || r.ReporterID != 0 || r.SnippetTitle != "Cheap watches" || r.Reason != "Spam score 6.0: blocked terms: watches" {
+			t.Errorf("got report %+v", r)
+		}
+	}
+}
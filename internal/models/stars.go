@@ -0,0 +1,38 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type StarModel struct {
+	DB *sql.DB
+}
+
+// Insert stars a snippet on behalf of a user. Starring a snippet twice is not
+// an error, the primary key on (user_id, snippet_id) makes it a no-op.
+func (m *StarModel) Insert(userID, snippetID int) error {
+	stmt := `
+	INSERT INTO snippet_star (user_id, snippet_id, created)
+	VALUES ($1, $2, localtimestamp)
+	ON CONFLICT (user_id, snippet_id) DO NOTHING;
+	`
+
+	_, err := m.DB.Exec(stmt, userID, snippetID)
+	return err
+}
+
+func (m *StarModel) Delete(userID, snippetID int) error {
+	stmt := `DELETE FROM snippet_star WHERE user_id = $1 AND snippet_id = $2;`
+
+	_, err := m.DB.Exec(stmt, userID, snippetID)
+	return err
+}
+
+func (m *StarModel) Exists(userID, snippetID int) (bool, error) {
+	var exists bool
+
+	stmt := `SELECT EXISTS(SELECT true FROM snippet_star WHERE user_id = $1 AND snippet_id = $2);`
+
+	err := m.DB.QueryRow(stmt, userID, snippetID).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"database/sql"
+)
+
+// Stats are the figures shown on the admin dashboard.
+type Stats struct {
+	Users          int
+	DisabledUsers  int
+	Snippets       int
+	ActiveSnippets int
+	Sessions       int
+}
+
+type StatsModel struct {
+	DB *sql.DB
+}
+
+func (m *StatsModel) Get() (*Stats, error) {
+	stmt := `
+	SELECT
+		(SELECT count(*) FROM users),
+		(SELECT count(*) FROM users WHERE disabled_at IS NOT NULL),
+		(SELECT count(*) FROM snippet),
+		(SELECT count(*) FROM snippet WHERE expired > localtimestamp),
+		(SELECT count(*) FROM sessions WHERE expiry > current_timestamp);
+	`
+
+	s := &Stats{}
+
+	err := m.DB.QueryRow(stmt).Scan(&s.Users, &s.DisabledUsers, &s.Snippets, &s.ActiveSnippets, &s.Sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Pool returns the statistics of the database connection pool.
+func (m *StatsModel) Pool() sql.DBStats {
+	return m.DB.Stats()
+}
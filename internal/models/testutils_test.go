@@ -0,0 +1,80 @@
+package models
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// newTestDB connect to the database of SNIPPETBOX_TEST_DSN and create the
+// tables of internal/sql, they are dropped again when the test ends. The
+// database must be a throwaway one. The test is skipped when the variable
+// isn't set.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("SNIPPETBOX_TEST_DSN")
+	if dsn == "" {
+		t.Skip("SNIPPETBOX_TEST_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		defer db.Close()
+
+		_, err := db.Exec(`DROP SCHEMA public CASCADE; CREATE SCHEMA public;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// users and snippet are referenced by the other tables
+	files := []string{"snippet_user.sql", "snippet_table.sql"}
+	others, err := filepath.Glob("../sql/snippet_*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range others {
+		name := filepath.Base(path)
+		if name != "snippet_user.sql" && name != "snippet_table.sql" && name != "snippet_fixture.sql" {
+			files = append(files, name)
+		}
+	}
+
+	for _, name := range files {
+		script, err := os.ReadFile(filepath.Join("../sql", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.Exec(string(script))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+
+	return db
+}
+
+// insertTestUser create a user and returns its ID.
+func insertTestUser(t *testing.T, db *sql.DB, email string) int {
+	t.Helper()
+
+	var id int
+	err := db.QueryRow(`
+	INSERT INTO users (name, email, password_hash, created)
+	VALUES ('Test', $1, '', localtimestamp) RETURNING id;
+	`, email).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
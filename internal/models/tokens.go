@@ -0,0 +1,126 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Token scopes, a token can only be used for the action it was created for.
+const (
+	ScopePasswordReset = "password-reset"
+)
+
+type TokenModel struct {
+	DB *sql.DB
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// New create a token for the user valid for ttl and returns its plain text
+// value, which is the only time it is available.
+func (m *TokenModel) New(userID int, scope string, ttl time.Duration) (string, error) {
+	random := make([]byte, 20)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	token := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(random)
+
+	stmt := `
+	INSERT INTO tokens (hash, user_id, scope, expiry)
+	VALUES ($1, $2, $3, localtimestamp + ($4 || ' SECONDS')::INTERVAL);
+	`
+
+	_, err = m.DB.Exec(stmt, hashToken(token), userID, scope, int(ttl.Seconds()))
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Check returns the user a valid token belongs to, without using it up.
+func (m *TokenModel) Check(token, scope string) (int, error) {
+	var userID int
+
+	stmt := `
+	SELECT user_id FROM tokens
+	WHERE hash = $1 AND scope = $2 AND used IS NULL AND expiry > localtimestamp;
+	`
+
+	err := m.DB.QueryRow(stmt, hashToken(token), scope).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// ResetPassword use up a valid password reset token and set the new password
+// of its user, then returns the user. Both happen in one transaction: a token
+// can only be used once, even by concurrent requests, and it stays valid when
+// the password can't be changed. The other reset tokens of the user are
+// deleted too.
+func (m *TokenModel) ResetPassword(token, password string) (int, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+	UPDATE tokens SET used = localtimestamp
+	WHERE hash = $1 AND scope = $2 AND used IS NULL AND expiry > localtimestamp
+	RETURNING user_id;
+	`
+
+	var userID int
+	err = tx.QueryRow(stmt, hashToken(token), ScopePasswordReset).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+
+	_, err = tx.Exec(`UPDATE users SET password_hash = $2 WHERE id = $1;`, userID, string(hashedPassword))
+	if err != nil {
+		return 0, err
+	}
+
+	// any other reset link sent before is now useless
+	_, err = tx.Exec(`DELETE FROM tokens WHERE user_id = $1 AND scope = $2 AND used IS NULL;`, userID, ScopePasswordReset)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// DeleteAllForUser remove every token of the given scope for the user, e.g.
+// the other reset links once the password has been changed.
+func (m *TokenModel) DeleteAllForUser(userID int, scope string) error {
+	stmt := `DELETE FROM tokens WHERE user_id = $1 AND scope = $2;`
+
+	_, err := m.DB.Exec(stmt, userID, scope)
+	return err
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer create the spans of the queries. It uses the global tracer provider,
+// spans are dropped until the application set one up.
+var tracer = otel.Tracer("snippetbox.kamanazan.net/internal/models")
+
+// startSpan start the span of a model method, a child of the span in ctx.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "postgresql")),
+	)
+}
+
+// endSpan end the span of a model method, recording err when the query
+// failed. The errors of the models are answers, e.g. ErrNoRecord, the span
+// of a missing snippet didn't fail.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !expectedError(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func expectedError(err error) bool {
+	for _, expected := range []error{
+		ErrNoRecord,
+		ErrInvalidCredentials,
+		ErrDuplicateEmail,
+		ErrDuplicateSlug,
+		ErrUnverifiedEmail,
+		ErrAccountDisabled,
+		ErrDuplicateReport,
+	} {
+		if errors.Is(err, expected) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestEndSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus codes.Code
+	}{
+		{"success", nil, codes.Unset},
+		{"query failed", errors.New("pq: connection refused"), codes.Error},
+		{"no record", ErrNoRecord, codes.Unset},
+		{"wrapped expected error", fmt.Errorf("login: %w", ErrInvalidCredentials), codes.Unset},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, span := provider.Tracer("test").Start(context.Background(), tt.name)
+			endSpan(span, tt.err)
+
+			ended := recorder.Ended()
+			got := ended[len(ended)-1]
+
+			if got.Name() != tt.name {
+				t.Fatalf("got span %q, want %q", got.Name(), tt.name)
+			}
+			if got.Status().Code != tt.wantStatus {
+				t.Errorf("got status %v, want %v", got.Status().Code, tt.wantStatus)
+			}
+
+			// the error is recorded as an exception event
+			recorded := len(got.Events()) == 1 && got.Events()[0].Name == "exception"
+			if recorded != (tt.wantStatus == codes.Error) {
+				t.Errorf("got events %+v", got.Events())
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// UserSession is a device where a user is logged in. Token is the scs session
+// token, it must never be shown to the user.
+type UserSession struct {
+	ID        int
+	Token     string
+	UserID    int
+	IP        string
+	UserAgent string
+	Created   time.Time
+	LastSeen  time.Time
+}
+
+type UserSessionModel struct {
+	DB *sql.DB
+}
+
+// Insert start tracking the session, and forget the sessions of the user which
+// expired or were destroyed without logging out.
+func (m *UserSessionModel) Insert(token string, userID int, ip, userAgent string) error {
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// scs only save a new session at the end of the request, give a few
+	// seconds to logins happening right now.
+	stmt := `
+	DELETE FROM user_sessions
+	WHERE user_id = $1 AND created < localtimestamp - INTERVAL '1 MINUTE'
+	AND token NOT IN (SELECT token FROM sessions WHERE expiry > current_timestamp);
+	`
+
+	_, err = tx.Exec(stmt, userID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `
+	INSERT INTO user_sessions (token, user_id, ip, user_agent, created, last_seen)
+	VALUES ($1, $2, $3, $4, localtimestamp, localtimestamp);
+	`
+
+	_, err = tx.Exec(stmt, token, userID, ip, userAgent)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Seen returns whether the session is still signed in for the user and update
+// its last activity, at most once a minute to spare a write on every request.
+func (m *UserSessionModel) Seen(token string, userID int, ip string) (bool, error) {
+	stmt := `
+	WITH touched AS (
+		UPDATE user_sessions SET last_seen = localtimestamp, ip = $3
+		WHERE token = $1 AND user_id = $2 AND last_seen < localtimestamp - INTERVAL '1 MINUTE'
+	)
+	SELECT EXISTS (SELECT 1 FROM user_sessions WHERE token = $1 AND user_id = $2);
+	`
+
+	var exists bool
+	err := m.DB.QueryRow(stmt, token, userID, ip).Scan(&exists)
+	return exists, err
+}
+
+// ByUser returns the active sessions of the user, most recently used first.
+func (m *UserSessionModel) ByUser(userID int) ([]*UserSession, error) {
+	stmt := `
+	SELECT us.id, us.token, us.user_id, us.ip, us.user_agent, us.created, us.last_seen
+	FROM user_sessions us JOIN sessions s ON s.token = us.token
+	WHERE us.user_id = $1 AND s.expiry > current_timestamp
+	ORDER BY us.last_seen DESC;
+	`
+
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*UserSession{}
+
+	for rows.Next() {
+		s := &UserSession{}
+		err := rows.Scan(&s.ID, &s.Token, &s.UserID, &s.IP, &s.UserAgent, &s.Created, &s.LastSeen)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Delete stop the session of the user and returns its token so the session
+// data can be destroyed too.
+func (m *UserSessionModel) Delete(id, userID int) (string, error) {
+	stmt := `DELETE FROM user_sessions WHERE id = $1 AND user_id = $2 RETURNING token;`
+
+	var token string
+	err := m.DB.QueryRow(stmt, id, userID).Scan(&token)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNoRecord
+		}
+		return "", err
+	}
+
+	return token, nil
+}
+
+// DeleteByToken stop the session with the given token, e.g. on logout.
+func (m *UserSessionModel) DeleteByToken(token string) error {
+	stmt := `DELETE FROM user_sessions WHERE token = $1;`
+
+	_, err := m.DB.Exec(stmt, token)
+	return err
+}
+
+// DeleteAllForUser stop every session of the user except the one with the
+// token keep (which can be empty) and returns the tokens of the stopped
+// sessions.
+func (m *UserSessionModel) DeleteAllForUser(userID int, keep string) ([]string, error) {
+	stmt := `DELETE FROM user_sessions WHERE user_id = $1 AND token <> $2 RETURNING token;`
+
+	rows, err := m.DB.Query(stmt, userID, keep)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []string
+
+	for rows.Next() {
+		var token string
+		err := rows.Scan(&token)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
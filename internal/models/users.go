@@ -1,9 +1,11 @@
 package models
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"strings"
 	"time"
 
@@ -17,48 +19,508 @@ type Users struct {
 	Email        string
 	PasswordHash string
 	Created      time.Time
+	Verified     bool
+	TOTPEnabled  bool
+	Role         string
+	Disabled     bool
 }
 
+// Roles, each role can do everything the roles before it can.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{RoleUser: 0, RoleModerator: 1, RoleAdmin: 2}
+
+// ValidRole returns whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// HasRole returns whether the user has the role or a more powerful one.
+func (u *Users) HasRole(role string) bool {
+	rank, ok := roleRanks[role]
+	return ok && roleRanks[u.Role] >= rank
+}
+
+// userColumns is the column list shared by every query returning a Users.
+const userColumns = `id, name, email, password_hash, created, verified_at IS NOT NULL, totp_enabled, role, disabled_at IS NOT NULL`
+
+// dummyHash is compared with the password of unknown emails, it has the same
+// cost as the real hashes.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), 12)
+
 type UsersModel struct {
 	DB *sql.DB
 }
 
-func (user *UsersModel) Insert(name, email, password string) error {
+// Insert create a new, unverified, user and returns its ID.
+func (user *UsersModel) Insert(ctx context.Context, name, email, password string) (_ int, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.Insert")
+	defer func() { endSpan(span, err) }()
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	stmt := `
 	INSERT INTO users(name, email, password_hash, created)
-	VALUES($1, $2, $3, localtimestamp);
+	VALUES($1, $2, $3, localtimestamp) RETURNING id;
 	`
 
-	_, err = user.DB.Exec(stmt, name, email, string(hashedPassword))
+	var id int
+	err = user.DB.QueryRowContext(ctx, stmt, name, email, string(hashedPassword)).Scan(&id)
 	if err != nil {
 		/*
 			23505	unique_violation
 		*/
 		var pgErr *pq.Error
 
-		if errors.As(err, &pgErr) {
-			if strings.Contains(pgErr.Message, "users_email_key") {
-				fmt.Printf("duplicate error %s", pgErr)
-				return ErrDuplicateEmail
-			} else {
-				fmt.Printf("unknown error %s", pgErr)
-				return pgErr
-			}
+		if errors.As(err, &pgErr) && strings.Contains(pgErr.Message, "users_email_key") {
+			return 0, ErrDuplicateEmail
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (user *UsersModel) Authenticate(ctx context.Context, email, password string) (_ int, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.Authenticate")
+	defer func() { endSpan(span, err) }()
+
+	var id int
+	var hashedPassword []byte
+
+	var disabled bool
+
+	stmt := `SELECT id, password_hash, disabled_at IS NOT NULL FROM users WHERE email = $1;`
+
+	err = user.DB.QueryRowContext(ctx, stmt, email).Scan(&id, &hashedPassword, &disabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Spend the same time as for a wrong password, otherwise the
+			// response time tell whether the email has an account.
+			bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+			return 0, ErrInvalidCredentials
+		}
+		return 0, err
+	}
+
+	// bcrypt give a specific error when the password does not match the hash,
+	// we translate it to ErrInvalidCredentials so the handler does not need to know about bcrypt.
+	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return 0, ErrInvalidCredentials
 		}
+		return 0, err
+	}
+
+	// only told once the password is known to be right
+	if disabled {
+		return 0, ErrAccountDisabled
+	}
+
+	return id, nil
+}
+
+func (user *UsersModel) Get(ctx context.Context, id int) (_ *Users, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.Get")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `SELECT ` + userColumns + ` FROM users WHERE id = $1;`
+
+	u := &Users{}
+
+	err = user.DB.QueryRowContext(ctx, stmt, id).Scan(&u.ID, &u.Name, &u.Email, &u.PasswordHash, &u.Created, &u.Verified, &u.TOTPEnabled, &u.Role, &u.Disabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (user *UsersModel) GetByEmail(ctx context.Context, email string) (_ *Users, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.GetByEmail")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `SELECT ` + userColumns + ` FROM users WHERE email = $1;`
+
+	u := &Users{}
+
+	err = user.DB.QueryRowContext(ctx, stmt, email).Scan(&u.ID, &u.Name, &u.Email, &u.PasswordHash, &u.Created, &u.Verified, &u.TOTPEnabled, &u.Role, &u.Disabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (user *UsersModel) UpdatePassword(ctx context.Context, id int, password string) (err error) {
+	ctx, span := startSpan(ctx, "UsersModel.UpdatePassword")
+	defer func() { endSpan(span, err) }()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE users SET password_hash = $2 WHERE id = $1;`
+
+	_, err = user.DB.ExecContext(ctx, stmt, id, string(hashedPassword))
+	return err
+}
+
+// SetRole change the role of the user with the given email, roles can only be
+// given from the command line (see cmd/admin).
+func (user *UsersModel) SetRole(ctx context.Context, email, role string) (err error) {
+	ctx, span := startSpan(ctx, "UsersModel.SetRole")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `UPDATE users SET role = $2 WHERE email = $1;`
+
+	result, err := user.DB.ExecContext(ctx, stmt, email, role)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
 	}
 
 	return nil
 }
 
-func (user *UsersModel) Authenticate(email, password string) (int, error) {
-	return 0, nil
+// SetDisabled disable or enable the account of the user.
+func (user *UsersModel) SetDisabled(ctx context.Context, id int, disabled bool) (err error) {
+	ctx, span := startSpan(ctx, "UsersModel.SetDisabled")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `UPDATE users SET disabled_at = CASE WHEN $2 THEN localtimestamp END WHERE id = $1;`
+
+	_, err = user.DB.ExecContext(ctx, stmt, id, disabled)
+	return err
 }
 
-func (user *UsersModel) Exists(name, email string) (bool, error) {
-	return false, nil
+// Search returns a page of users whose name or email contains the search,
+// and the number of matching users.
+func (user *UsersModel) Search(ctx context.Context, search string, limit, offset int) (_ []*Users, _ int, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.Search")
+	defer func() { endSpan(span, err) }()
+
+	pattern := "%" + escapeLike(search) + "%"
+
+	var total int
+	err = user.DB.QueryRowContext(ctx, `SELECT count(*) FROM users WHERE name ILIKE $1 OR email ILIKE $1;`, pattern).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stmt := `
+	SELECT ` + userColumns + ` FROM users
+	WHERE name ILIKE $1 OR email ILIKE $1
+	ORDER BY id LIMIT $2 OFFSET $3;
+	`
+
+	rows, err := user.DB.QueryContext(ctx, stmt, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*Users{}
+
+	for rows.Next() {
+		u := &Users{}
+		err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.PasswordHash, &u.Created, &u.Verified, &u.TOTPEnabled, &u.Role, &u.Disabled)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+// UpdateName change the display name of the user.
+func (user *UsersModel) UpdateName(ctx context.Context, id int, name string) (err error) {
+	ctx, span := startSpan(ctx, "UsersModel.UpdateName")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `UPDATE users SET name = $2 WHERE id = $1;`
+
+	_, err = user.DB.ExecContext(ctx, stmt, id, name)
+	return err
+}
+
+// UpdateEmail change the email of the user, the new address has to be
+// verified again.
+func (user *UsersModel) UpdateEmail(ctx context.Context, id int, email string) (err error) {
+	ctx, span := startSpan(ctx, "UsersModel.UpdateEmail")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `
+	UPDATE users SET email = $2, verified_at = NULL, verification_sent = NULL
+	WHERE id = $1;
+	`
+
+	_, err = user.DB.ExecContext(ctx, stmt, id, email)
+	if err != nil {
+		var pgErr *pq.Error
+		if errors.As(err, &pgErr) && strings.Contains(pgErr.Message, "users_email_key") {
+			return ErrDuplicateEmail
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (user *UsersModel) Exists(ctx context.Context, id int) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.Exists")
+	defer func() { endSpan(span, err) }()
+
+	var exists bool
+
+	stmt := `SELECT EXISTS(SELECT true FROM users WHERE id = $1);`
+
+	err = user.DB.QueryRowContext(ctx, stmt, id).Scan(&exists)
+	return exists, err
+}
+
+// MarkVerified record that the user proved they own their email address.
+func (user *UsersModel) MarkVerified(ctx context.Context, id int) (err error) {
+	ctx, span := startSpan(ctx, "UsersModel.MarkVerified")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `UPDATE users SET verified_at = localtimestamp WHERE id = $1 AND verified_at IS NULL;`
+
+	_, err = user.DB.ExecContext(ctx, stmt, id)
+	return err
+}
+
+// AllowVerificationMail record that a verification mail is about to be sent.
+// It returns false, without recording anything, when the previous one was sent
+// less than `interval` ago so users can't flood an inbox with resends.
+func (user *UsersModel) AllowVerificationMail(ctx context.Context, id int, interval time.Duration) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.AllowVerificationMail")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `
+	UPDATE users SET verification_sent = localtimestamp
+	WHERE id = $1 AND (verification_sent IS NULL OR verification_sent < localtimestamp - ($2 || ' SECONDS')::INTERVAL)
+	RETURNING id;
+	`
+
+	err = user.DB.QueryRowContext(ctx, stmt, id, int(interval.Seconds())).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SetTOTPSecret store a new encrypted TOTP secret for the user. Two-factor
+// authentication stays disabled until EnableTOTP is called, once the user
+// proved their authenticator app produce valid codes.
+func (user *UsersModel) SetTOTPSecret(ctx context.Context, id int, encryptedSecret []byte) (err error) {
+	ctx, span := startSpan(ctx, "UsersModel.SetTOTPSecret")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `UPDATE users SET totp_secret = $2, totp_enabled = false, totp_last_step = 0 WHERE id = $1;`
+
+	_, err = user.DB.ExecContext(ctx, stmt, id, encryptedSecret)
+	return err
+}
+
+// TOTPSecret returns the encrypted TOTP secret of the user, nil when there is
+// none.
+func (user *UsersModel) TOTPSecret(ctx context.Context, id int) (_ []byte, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.TOTPSecret")
+	defer func() { endSpan(span, err) }()
+
+	var secret []byte
+
+	stmt := `SELECT totp_secret FROM users WHERE id = $1;`
+
+	err = user.DB.QueryRowContext(ctx, stmt, id).Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+func (user *UsersModel) EnableTOTP(ctx context.Context, id int) (err error) {
+	ctx, span := startSpan(ctx, "UsersModel.EnableTOTP")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `UPDATE users SET totp_enabled = true WHERE id = $1 AND totp_secret IS NOT NULL;`
+
+	_, err = user.DB.ExecContext(ctx, stmt, id)
+	return err
+}
+
+func (user *UsersModel) DisableTOTP(ctx context.Context, id int) (err error) {
+	ctx, span := startSpan(ctx, "UsersModel.DisableTOTP")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `UPDATE users SET totp_secret = NULL, totp_enabled = false, totp_last_step = 0 WHERE id = $1;`
+
+	_, err = user.DB.ExecContext(ctx, stmt, id)
+	return err
+}
+
+// UseTOTPStep record the time step of an accepted TOTP code. It returns false
+// when a code of the same or a later step was already used, which means the
+// code is being replayed.
+func (user *UsersModel) UseTOTPStep(ctx context.Context, id int, step int64) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.UseTOTPStep")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `UPDATE users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2 RETURNING id;`
+
+	err = user.DB.QueryRowContext(ctx, stmt, id, step).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// FromOIDC returns the user of an identity from the SSO provider, creating the
+// account on the first login. subject uniquely identify the identity at the
+// provider. An existing account with the same email is linked to the identity,
+// so callers must only pass emails the provider verified. The account must
+// have verified the email too, ErrUnverifiedEmail is returned otherwise.
+func (user *UsersModel) FromOIDC(ctx context.Context, subject, email, name string) (_ int, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.FromOIDC")
+	defer func() { endSpan(span, err) }()
+
+	tx, err := user.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+
+	err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE oidc_subject = $1;`, subject).Scan(&id)
+	if err == nil {
+		return id, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	// Link an account created with a password, only when it verified the
+	// email: anybody can sign up with the address of someone else, and would
+	// keep the password of the account once the owner linked it.
+	stmt := `
+	UPDATE users SET oidc_subject = $1
+	WHERE email = $2 AND oidc_subject IS NULL AND verified_at IS NOT NULL
+	RETURNING id;
+	`
+
+	err = tx.QueryRowContext(ctx, stmt, subject, email).Scan(&id)
+	if err == nil {
+		return id, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	var unverified bool
+	stmt = `SELECT EXISTS (SELECT 1 FROM users WHERE email = $1 AND oidc_subject IS NULL);`
+
+	err = tx.QueryRowContext(ctx, stmt, email).Scan(&unverified)
+	if err != nil {
+		return 0, err
+	}
+	if unverified {
+		return 0, ErrUnverifiedEmail
+	}
+
+	// Just-in-time creation. The account get a random password nobody knows,
+	// the user can still set one later with the password reset flow.
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(random)), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `
+	INSERT INTO users (name, email, password_hash, created, verified_at, oidc_subject)
+	VALUES ($1, $2, $3, localtimestamp, localtimestamp, $4) RETURNING id;
+	`
+
+	err = tx.QueryRowContext(ctx, stmt, name, email, string(hashedPassword), subject).Scan(&id)
+	if err != nil {
+		var pgErr *pq.Error
+		if errors.As(err, &pgErr) && strings.Contains(pgErr.Message, "users_email_key") {
+			// the email belong to an account linked to another identity
+			return 0, ErrDuplicateEmail
+		}
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// PostingActivity returns the age of the account and the number of snippets
+// the user created in the last hour, used to spot new spam accounts.
+func (user *UsersModel) PostingActivity(ctx context.Context, id int) (_ time.Duration, _ int, err error) {
+	ctx, span := startSpan(ctx, "UsersModel.PostingActivity")
+	defer func() { endSpan(span, err) }()
+
+	stmt := `
+	SELECT EXTRACT(EPOCH FROM localtimestamp - users.created),
+		(SELECT count(*) FROM snippet WHERE snippet.user_id = users.id AND snippet.created > localtimestamp - INTERVAL '1 HOUR')
+	FROM users WHERE id = $1;
+	`
+
+	var seconds float64
+	var recent int
+	err = user.DB.QueryRowContext(ctx, stmt, id).Scan(&seconds, &recent)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, ErrNoRecord
+		}
+		return 0, 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), recent, nil
 }
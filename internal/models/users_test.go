@@ -0,0 +1,62 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUsersFromOIDC(t *testing.T) {
+	db := newTestDB(t)
+	m := &UsersModel{DB: db}
+	ctx := context.Background()
+
+	verified := insertTestUser(t, db, "verified@example.com")
+	_, err := db.Exec(`UPDATE users SET verified_at = localtimestamp WHERE id = $1;`, verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertTestUser(t, db, "unverified@example.com")
+
+	// an account whose email was verified is linked
+	id, err := m.FromOIDC(ctx, "issuer 1", "verified@example.com", "Verified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != verified {
+		t.Errorf("linked to user %d, want %d", id, verified)
+	}
+
+	// the next login find it by subject
+	id, err = m.FromOIDC(ctx, "issuer 1", "verified@example.com", "Verified")
+	if err != nil || id != verified {
+		t.Errorf("second login: got %d, %v, want %d", id, err, verified)
+	}
+
+	// someone may have signed up with the address of the SSO user
+	_, err = m.FromOIDC(ctx, "issuer 2", "unverified@example.com", "Unverified")
+	if !errors.Is(err, ErrUnverifiedEmail) {
+		t.Errorf("unverified account: got %v, want ErrUnverifiedEmail", err)
+	}
+
+	// another identity with the email of a linked account
+	_, err = m.FromOIDC(ctx, "issuer 3", "verified@example.com", "Verified")
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("linked email: got %v, want ErrDuplicateEmail", err)
+	}
+
+	// just-in-time account, verified by the provider
+	id, err = m.FromOIDC(ctx, "issuer 4", "new@example.com", "New")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := m.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "new@example.com" || !user.Verified {
+		t.Errorf("got %+v", user)
+	}
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// View is a single hit on a snippet page, as collected by the handler.
+type View struct {
+	SnippetID int
+	Visitor   string
+	Referrer  string
+	Time      time.Time
+}
+
+type DailyViews struct {
+	Day   time.Time
+	Views int
+}
+
+type ReferrerViews struct {
+	Referrer string
+	Views    int
+}
+
+type ViewModel struct {
+	DB *sql.DB
+}
+
+// Record count the view in the daily aggregates. A visitor is only counted
+// once per snippet and per day, repeated views are silently ignored.
+func (m *ViewModel) Record(v View) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	day := v.Time.Format("2006-01-02")
+
+	stmt := `
+	INSERT INTO snippet_view_visitor (snippet_id, day, visitor) VALUES ($1, $2, $3)
+	ON CONFLICT (snippet_id, day, visitor) DO NOTHING;
+	`
+
+	result, err := tx.Exec(stmt, v.SnippetID, day, v.Visitor)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	stmt = `
+	INSERT INTO snippet_view_daily (snippet_id, day, views) VALUES ($1, $2, 1)
+	ON CONFLICT (snippet_id, day) DO UPDATE SET views = snippet_view_daily.views + 1;
+	`
+
+	_, err = tx.Exec(stmt, v.SnippetID, day)
+	if err != nil {
+		return err
+	}
+
+	stmt = `
+	INSERT INTO snippet_view_referrer (snippet_id, day, referrer, views) VALUES ($1, $2, $3, 1)
+	ON CONFLICT (snippet_id, day, referrer) DO UPDATE SET views = snippet_view_referrer.views + 1;
+	`
+
+	_, err = tx.Exec(stmt, v.SnippetID, day, v.Referrer)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteVisitorsBefore delete the visitors recorded before day and returns how
+// many were deleted. The daily counts are kept.
+func (m *ViewModel) DeleteVisitorsBefore(day time.Time) (int64, error) {
+	stmt := `DELETE FROM snippet_view_visitor WHERE day < $1;`
+
+	result, err := m.DB.Exec(stmt, day.Format("2006-01-02"))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Daily returns the number of views of a snippet for each of the last `days`
+// days which had at least one view, most recent day first.
+func (m *ViewModel) Daily(snippetID, days int) ([]*DailyViews, error) {
+	stmt := `
+	SELECT day, views FROM snippet_view_daily
+	WHERE snippet_id = $1 AND day > (current_date - $2::INTEGER)
+	ORDER BY day DESC;
+	`
+
+	rows, err := m.DB.Query(stmt, snippetID, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	daily := []*DailyViews{}
+
+	for rows.Next() {
+		d := &DailyViews{}
+		err := rows.Scan(&d.Day, &d.Views)
+		if err != nil {
+			return nil, err
+		}
+
+		daily = append(daily, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return daily, nil
+}
+
+// Referrers returns the hosts which sent visitors to a snippet during the last
+// `days` days, busiest first. Direct visits have an empty Referrer.
+func (m *ViewModel) Referrers(snippetID, days int) ([]*ReferrerViews, error) {
+	stmt := `
+	SELECT referrer, SUM(views) FROM snippet_view_referrer
+	WHERE snippet_id = $1 AND day > (current_date - $2::INTEGER)
+	GROUP BY referrer
+	ORDER BY SUM(views) DESC
+	LIMIT 20;
+	`
+
+	rows, err := m.DB.Query(stmt, snippetID, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referrers := []*ReferrerViews{}
+
+	for rows.Next() {
+		rv := &ReferrerViews{}
+		err := rows.Scan(&rv.Referrer, &rv.Views)
+		if err != nil {
+			return nil, err
+		}
+
+		referrers = append(referrers, rv)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return referrers, nil
+}
+
+// Total returns the number of deduplicated views of a snippet since it was
+// created.
+func (m *ViewModel) Total(snippetID int) (int, error) {
+	var total int
+
+	stmt := `SELECT COALESCE(SUM(views), 0) FROM snippet_view_daily WHERE snippet_id = $1;`
+
+	err := m.DB.QueryRow(stmt, snippetID).Scan(&total)
+	return total, err
+}
@@ -0,0 +1,200 @@
+// Package policy scores snippet submissions against spam and abuse
+// heuristics. Each heuristic is a Rule adding to the score of the submission,
+// the Engine then decides from the total whether the snippet is published,
+// quarantined until a moderator review it, or rejected.
+package policy
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Decisions of the engine.
+const (
+	Accept     = "accept"
+	Quarantine = "quarantine"
+	Reject     = "reject"
+)
+
+// Submission is a snippet about to be created and what we know about its
+// author.
+type Submission struct {
+	Title   string
+	Content string
+	// the author is not logged in, AccountAge and RecentSnippets are unknown
+	Anonymous bool
+	// age of the author account
+	AccountAge time.Duration
+	// snippets created by the author in the last hour
+	RecentSnippets int
+}
+
+// Rule is a single heuristic. It returns the score it adds to the submission
+// and why, a zero score when the rule doesn't apply.
+type Rule interface {
+	Check(s *Submission) (float64, string)
+}
+
+// Verdict is the outcome of the evaluation of a submission.
+type Verdict struct {
+	Decision string
+	Score    float64
+	Reasons  []string
+}
+
+// Engine sums the score of its rules. A submission reaching RejectAt is
+// rejected, one reaching QuarantineAt is quarantined, a threshold of 0 is
+// never reached.
+type Engine struct {
+	Rules        []Rule
+	QuarantineAt float64
+	RejectAt     float64
+}
+
+// Evaluate runs every rule on the submission.
+func (e *Engine) Evaluate(s *Submission) Verdict {
+	v := Verdict{Decision: Accept}
+
+	for _, rule := range e.Rules {
+		score, reason := rule.Check(s)
+		if score > 0 {
+			v.Score += score
+			v.Reasons = append(v.Reasons, reason)
+		}
+	}
+
+	switch {
+	case e.RejectAt > 0 && v.Score >= e.RejectAt:
+		v.Decision = Reject
+	case e.QuarantineAt > 0 && v.Score >= e.QuarantineAt:
+		v.Decision = Quarantine
+	}
+
+	return v
+}
+
+var linkRx = regexp.MustCompile(`(?i)https?://[^\s"'<>()]+`)
+
+// LinkDensity flags submissions made mostly of links. It applies from
+// MinLinks links when more than MaxRatio of the words are links.
+type LinkDensity struct {
+	MinLinks int
+	MaxRatio float64
+	Score    float64
+}
+
+func (r LinkDensity) Check(s *Submission) (float64, string) {
+	links := len(linkRx.FindAllString(s.Content, -1))
+	words := len(strings.Fields(s.Content))
+
+	if links < r.MinLinks || words == 0 || float64(links)/float64(words) <= r.MaxRatio {
+		return 0, ""
+	}
+
+	return r.Score, fmt.Sprintf("%d links in %d words", links, words)
+}
+
+// Repetition flags submissions repeating the same lines over and over. Short
+// lines are ignored, code is full of closing braces and blank lines.
+type Repetition struct {
+	MinLines int
+	// the ratio of distinct lines under which the rule applies
+	MinDistinct float64
+	Score       float64
+}
+
+func (r Repetition) Check(s *Submission) (float64, string) {
+	lines := 0
+	distinct := map[string]bool{}
+
+	for _, line := range strings.Split(s.Content, "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if len(line) < 10 {
+			continue
+		}
+		lines++
+		distinct[line] = true
+	}
+
+	if lines < r.MinLines || float64(len(distinct))/float64(lines) >= r.MinDistinct {
+		return 0, ""
+	}
+
+	return r.Score, fmt.Sprintf("%d distinct lines out of %d", len(distinct), lines)
+}
+
+// BlockedTerms flags links to blocked domains, or their subdomains, and
+// blocked keywords in the title or the content. Each distinct term found adds
+// Score.
+type BlockedTerms struct {
+	Domains  []string
+	Keywords []string
+	Score    float64
+}
+
+func (r BlockedTerms) Check(s *Submission) (float64, string) {
+	var found []string
+
+	hosts := map[string]bool{}
+	for _, link := range linkRx.FindAllString(s.Content, -1) {
+		u, err := url.Parse(link)
+		if err == nil {
+			hosts[strings.ToLower(u.Hostname())] = true
+		}
+	}
+
+	for _, domain := range r.Domains {
+		for host := range hosts {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				found = append(found, domain)
+				break
+			}
+		}
+	}
+
+	text := strings.ToLower(s.Title + "\n" + s.Content)
+	for _, keyword := range r.Keywords {
+		if strings.Contains(text, keyword) {
+			found = append(found, keyword)
+		}
+	}
+
+	if len(found) == 0 {
+		return 0, ""
+	}
+
+	return r.Score * float64(len(found)), "blocked terms: " + strings.Join(found, ", ")
+}
+
+// NewAccountRate flags accounts younger than MinAge posting more than
+// MaxSnippets snippets an hour, the usual pattern of spam accounts. It doesn't
+// apply to anonymous submissions.
+type NewAccountRate struct {
+	MinAge      time.Duration
+	MaxSnippets int
+	Score       float64
+}
+
+func (r NewAccountRate) Check(s *Submission) (float64, string) {
+	if s.Anonymous || s.AccountAge >= r.MinAge || s.RecentSnippets < r.MaxSnippets {
+		return 0, ""
+	}
+
+	return r.Score, fmt.Sprintf("%d snippets in the last hour from an account created %s ago", s.RecentSnippets, s.AccountAge.Round(time.Minute))
+}
+
+// Terms splits a comma separated list of domains or keywords, they are
+// compared in lower case.
+func Terms(list string) []string {
+	var terms []string
+	for _, term := range strings.Split(list, ",") {
+		term = strings.ToLower(strings.TrimSpace(term))
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
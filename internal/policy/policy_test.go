@@ -0,0 +1,225 @@
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLinkDensity(t *testing.T) {
+	rule := LinkDensity{MinLinks: 3, MaxRatio: 0.3, Score: 4}
+
+	tests := []struct {
+		name    string
+		content string
+		want    float64
+	}{
+		{"no links", "func main() { fmt.Println(\"hello\") }", 0},
+		{"empty", "", 0},
+		{"only links", "https://a.example http://b.example https://c.example", 4},
+		{"links in few words", "buy https://a.example/x now https://b.example/y cheap https://c.example/z", 4},
+		{"under MinLinks", "https://a.example https://b.example", 0},
+		{"links in a long text", "see https://a.example https://b.example https://c.example for the " +
+			"documentation of the function, the tests and the benchmarks of the package", 0},
+		{"ratio at MaxRatio", "https://a.example https://b.example https://c.example " + strings.Repeat("word ", 7), 0},
+		{"links without scheme", "a.example b.example c.example d.example", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := rule.Check(&Submission{Content: tt.content})
+			if got != tt.want {
+				t.Errorf("got score %v (%q), want %v", got, reason, tt.want)
+			}
+			if (got > 0) != (reason != "") {
+				t.Errorf("got reason %q with score %v", reason, got)
+			}
+		})
+	}
+}
+
+func TestRepetition(t *testing.T) {
+	rule := Repetition{MinLines: 5, MinDistinct: 0.3, Score: 4}
+
+	tests := []struct {
+		name    string
+		content string
+		want    float64
+	}{
+		{"same line", strings.Repeat("buy cheap watches today\n", 10), 4},
+		{"case and spaces", strings.Repeat("Buy cheap watches today\n  buy CHEAP watches today  \n", 5), 4},
+		{"two lines", strings.Repeat("buy cheap watches today\nvisit our store right now\n", 5), 4},
+		{"under MinLines", strings.Repeat("buy cheap watches today\n", 4), 0},
+		{"distinct lines", "line number one here\nline number two here\nline number three here\n" +
+			"line number four here\nline number five here\n", 0},
+		{"short lines ignored", strings.Repeat("}\n\n\treturn\n", 50) + "func main() {\n", 0},
+		{"at MinDistinct", strings.Repeat("the first long line\nthe second long line\nthe third long line\n"+
+			"the fourth long line\nthe fifth long line\nthe sixth long line\n", 2) +
+			"the same long line\nthe same long line\nthe same long line\nthe same long line\n", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := rule.Check(&Submission{Content: tt.content})
+			if got != tt.want {
+				t.Errorf("got score %v (%q), want %v", got, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlockedTerms(t *testing.T) {
+	rule := BlockedTerms{
+		Domains:  Terms("spam.example, casino.example"),
+		Keywords: Terms("Viagra, free money"),
+		Score:    6,
+	}
+
+	tests := []struct {
+		name       string
+		title      string
+		content    string
+		want       float64
+		wantReason string
+	}{
+		{"clean", "Hello", "fmt.Println(\"hello\")", 0, ""},
+		{"domain", "", "see https://spam.example/offer", 6, "blocked terms: spam.example"},
+		{"subdomain", "", "see https://www.spam.example", 6, "blocked terms: spam.example"},
+		{"domain upper case", "", "see HTTPS://WWW.SPAM.EXAMPLE/", 6, "blocked terms: spam.example"},
+		{"domain with port", "", "http://spam.example:8080/x", 6, "blocked terms: spam.example"},
+		{"similar domain", "", "https://notspam.example and https://spam.example.org", 0, ""},
+		{"domain outside a link", "", "spam.example is a bad site", 0, ""},
+		{"domain in the path", "", "https://good.example/spam.example", 0, ""},
+		{"keyword in the title", "FREE MONEY", "", 6, "blocked terms: free money"},
+		{"keyword in the content", "", "cheap viagra here", 6, "blocked terms: viagra"},
+		{"each term once", "viagra", "viagra https://spam.example https://spam.example/again", 12, "blocked terms: spam.example, viagra"},
+		{"all terms", "free money", "viagra https://casino.example https://spam.example", 24, "blocked terms: spam.example, casino.example, viagra, free money"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := rule.Check(&Submission{Title: tt.title, Content: tt.content})
+			if got != tt.want || reason != tt.wantReason {
+				t.Errorf("got %v %q, want %v %q", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestNewAccountRate(t *testing.T) {
+	rule := NewAccountRate{MinAge: 24 * time.Hour, MaxSnippets: 5, Score: 5}
+
+	tests := []struct {
+		name       string
+		submission Submission
+		want       float64
+	}{
+		{"new account posting a lot", Submission{AccountAge: time.Hour, RecentSnippets: 5}, 5},
+		{"new account posting a little", Submission{AccountAge: time.Hour, RecentSnippets: 4}, 0},
+		{"old account posting a lot", Submission{AccountAge: 24 * time.Hour, RecentSnippets: 50}, 0},
+		{"just created", Submission{RecentSnippets: 5}, 5},
+		{"anonymous", Submission{Anonymous: true, RecentSnippets: 50}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := rule.Check(&tt.submission)
+			if got != tt.want {
+				t.Errorf("got score %v (%q), want %v", got, reason, tt.want)
+			}
+		})
+	}
+}
+
+// fixedRule adds the same score to every submission.
+type fixedRule struct {
+	score  float64
+	reason string
+}
+
+func (r fixedRule) Check(*Submission) (float64, string) {
+	return r.score, r.reason
+}
+
+func TestEngineEvaluate(t *testing.T) {
+	tests := []struct {
+		name         string
+		rules        []Rule
+		quarantineAt float64
+		rejectAt     float64
+		want         Verdict
+	}{
+		{
+			name:         "no rules",
+			quarantineAt: 5, rejectAt: 10,
+			want: Verdict{Decision: Accept},
+		},
+		{
+			name:         "under the thresholds",
+			rules:        []Rule{fixedRule{2, "a"}, fixedRule{0, "not applied"}, fixedRule{2, "b"}},
+			quarantineAt: 5, rejectAt: 10,
+			want: Verdict{Decision: Accept, Score: 4, Reasons: []string{"a", "b"}},
+		},
+		{
+			name:         "at the quarantine threshold",
+			rules:        []Rule{fixedRule{2, "a"}, fixedRule{3, "b"}},
+			quarantineAt: 5, rejectAt: 10,
+			want: Verdict{Decision: Quarantine, Score: 5, Reasons: []string{"a", "b"}},
+		},
+		{
+			name:         "at the reject threshold",
+			rules:        []Rule{fixedRule{6, "a"}, fixedRule{4, "b"}},
+			quarantineAt: 5, rejectAt: 10,
+			want: Verdict{Decision: Reject, Score: 10, Reasons: []string{"a", "b"}},
+		},
+		{
+			name:         "quarantine disabled",
+			rules:        []Rule{fixedRule{6, "a"}},
+			quarantineAt: 0, rejectAt: 10,
+			want: Verdict{Decision: Accept, Score: 6, Reasons: []string{"a"}},
+		},
+		{
+			name:         "reject disabled",
+			rules:        []Rule{fixedRule{60, "a"}},
+			quarantineAt: 5, rejectAt: 0,
+			want: Verdict{Decision: Quarantine, Score: 60, Reasons: []string{"a"}},
+		},
+		{
+			name:         "both disabled",
+			rules:        []Rule{fixedRule{60, "a"}},
+			quarantineAt: 0, rejectAt: 0,
+			want: Verdict{Decision: Accept, Score: 60, Reasons: []string{"a"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Engine{Rules: tt.rules, QuarantineAt: tt.quarantineAt, RejectAt: tt.rejectAt}
+
+			got := e.Evaluate(&Submission{})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerms(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"", nil},
+		{" , ,", nil},
+		{"Spam.Example", []string{"spam.example"}},
+		{" a.example ,b.example,, Free Money ", []string{"a.example", "b.example", "free money"}},
+	}
+
+	for _, tt := range tests {
+		got := Terms(tt.list)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Terms(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package secrets finds credentials pasted in a text: cloud and API keys,
+// tokens, private keys and other high-entropy strings. The patterns favour
+// precision over recall, a false positive is more annoying to users than a
+// missed key.
+package secrets
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Match is a secret found in a text, Start and End are byte offsets.
+type Match struct {
+	Kind  string
+	Line  int
+	Start int
+	End   int
+}
+
+type pattern struct {
+	kind string
+	rx   *regexp.Regexp
+}
+
+var patterns = []pattern{
+	{"private key", regexp.MustCompile(`(?s)-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----.*?(?:-----END (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----|$)`)},
+	{"AWS access key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"AWS secret key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}\b`)},
+	{"GitHub token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"Slack webhook", regexp.MustCompile(`https://hooks\.slack\.com/services/T[A-Z0-9]+/B[A-Z0-9]+/[A-Za-z0-9]+`)},
+	{"JWT", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+}
+
+// Strings at least minEntropyLength long with more than minEntropy bits per
+// character are reported as secrets. Random base64 reach about 5 bits, words
+// and identifiers stay well below.
+const (
+	minEntropyLength = 32
+	minEntropy       = 4.5
+)
+
+var candidateRx = regexp.MustCompile(`[A-Za-z0-9+/=_-]{32,}`)
+
+// Scan returns the secrets found in text, ordered by position.
+func Scan(text string) []Match {
+	var matches []Match
+
+	for _, p := range patterns {
+		for _, loc := range p.rx.FindAllStringIndex(text, -1) {
+			matches = append(matches, Match{Kind: p.kind, Start: loc[0], End: loc[1]})
+		}
+	}
+
+	for _, loc := range candidateRx.FindAllStringIndex(text, -1) {
+		if overlaps(matches, loc[0], loc[1]) {
+			continue
+		}
+		if highEntropy(text[loc[0]:loc[1]]) {
+			matches = append(matches, Match{Kind: "high-entropy string", Start: loc[0], End: loc[1]})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Start < matches[j].Start
+	})
+
+	// patterns can overlap, e.g. a key inside a Slack webhook, keep the first
+	kept := matches[:0]
+	for _, m := range matches {
+		if overlaps(kept, m.Start, m.End) {
+			continue
+		}
+		m.Line = strings.Count(text[:m.Start], "\n") + 1
+		kept = append(kept, m)
+	}
+
+	return kept
+}
+
+// Redact replaces the matches found by Scan in text with a placeholder.
+func Redact(text string, matches []Match) string {
+	var b strings.Builder
+	last := 0
+
+	for _, m := range matches {
+		b.WriteString(text[last:m.Start])
+		b.WriteString("[REDACTED " + m.Kind + "]")
+		last = m.End
+	}
+	b.WriteString(text[last:])
+
+	return b.String()
+}
+
+func overlaps(matches []Match, start, end int) bool {
+	for _, m := range matches {
+		if start < m.End && m.Start < end {
+			return true
+		}
+	}
+	return false
+}
+
+// highEntropy tells if s looks random: mixed case letters and digits with a
+// high Shannon entropy.
+func highEntropy(s string) bool {
+	if len(s) < minEntropyLength {
+		return false
+	}
+
+	var upper, lower, digit bool
+	counts := map[rune]int{}
+	for _, c := range s {
+		counts[c]++
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		}
+	}
+
+	if !upper || !lower || !digit {
+		return false
+	}
+
+	entropy := 0.0
+	for _, n := range counts {
+		p := float64(n) / float64(len(s))
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy > minEntropy
+}
@@ -0,0 +1,27 @@
+-- append-only log of security-relevant actions. There is no foreign key on
+-- purpose: events must outlive the users and snippets they are about, the
+-- actor email is copied for the same reason.
+CREATE TABLE audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    created TIMESTAMP NOT NULL,
+    actor_id INTEGER,
+    actor_email VARCHAR(255) NOT NULL DEFAULT '',
+    action VARCHAR(64) NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL,
+    target VARCHAR(255) NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX audit_events_created_idx ON audit_events (created);
+CREATE INDEX audit_events_action_idx ON audit_events (action, created);
+
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
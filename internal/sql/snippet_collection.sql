@@ -0,0 +1,19 @@
+CREATE TABLE collection (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(150) NOT NULL,
+    slug VARCHAR(160) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    visibility VARCHAR(10) NOT NULL DEFAULT 'public' CHECK (visibility IN ('public', 'private')),
+    created TIMESTAMP NOT NULL
+);
+
+CREATE TABLE collection_snippet (
+    collection_id INTEGER NOT NULL REFERENCES collection(id) ON DELETE CASCADE,
+    snippet_id INTEGER NOT NULL REFERENCES snippet(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    PRIMARY KEY (collection_id, snippet_id)
+);
+
+-- a user can't have two collections with the same slug, other users can
+CREATE UNIQUE INDEX collection_user_slug_key ON collection (user_id, slug);
@@ -0,0 +1,12 @@
+-- WebAuthn credentials (passkeys). data hold the JSON encoded credential as
+-- returned by the webauthn library: public key, sign counter, flags...
+CREATE TABLE credentials (
+    id BYTEA PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    data JSONB NOT NULL,
+    created TIMESTAMP NOT NULL,
+    last_used TIMESTAMP
+);
+
+CREATE INDEX credentials_user_idx ON credentials (user_id);
@@ -0,0 +1,9 @@
+-- failed logins per account ("email:<address>") and per client ("ip:<address>").
+-- The counters live in the database so every app instance see the same
+-- attempts.
+CREATE TABLE login_throttle (
+    key VARCHAR(300) PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+);
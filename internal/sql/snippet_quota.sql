@@ -0,0 +1,7 @@
+-- actions counted per key ("snippet:user:<id>", "snippet:ip:<address>") in
+-- fixed windows, the window restart with the first action after it ended.
+CREATE TABLE quotas (
+    key VARCHAR(300) PRIMARY KEY,
+    window_start TIMESTAMP NOT NULL,
+    used INTEGER NOT NULL
+);
@@ -0,0 +1,20 @@
+-- abuse reports. Rows are kept once resolved as the trail of the moderation:
+-- who decided what and when. snippet_id is cleared when the snippet is
+-- deleted, the title is copied so the trail still make sense.
+CREATE TABLE reports (
+    id SERIAL PRIMARY KEY,
+    snippet_id INTEGER REFERENCES snippet(id) ON DELETE SET NULL,
+    snippet_title VARCHAR(150) NOT NULL,
+    reporter_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reason VARCHAR(500) NOT NULL,
+    -- filed by the content policy, reporter_id is then NULL
+    automatic BOOLEAN NOT NULL DEFAULT false,
+    created TIMESTAMP NOT NULL,
+    -- open, dismissed, hidden or deleted
+    status VARCHAR(16) NOT NULL DEFAULT 'open',
+    resolved_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    resolved_at TIMESTAMP
+);
+
+-- a user can only have one open report per snippet
+CREATE UNIQUE INDEX reports_open_idx ON reports (snippet_id, reporter_id) WHERE status = 'open';
@@ -0,0 +1,8 @@
+CREATE TABLE snippet_star (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    snippet_id INTEGER NOT NULL REFERENCES snippet(id) ON DELETE CASCADE,
+    created TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, snippet_id)
+);
+
+CREATE INDEX snippet_star_snippet_idx ON snippet_star (snippet_id, created);
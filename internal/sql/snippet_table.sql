@@ -3,5 +3,8 @@ CREATE TABLE snippet (
     title varchar(150) not null,
     content text not null,
     created timestamp not null,
-    expired timestamp not null
+    expired timestamp not null,
+    user_id integer references users(id) on delete set null,
+    -- set by moderation, a hidden snippet is only visible in the report queue
+    hidden_at timestamp
 );
\ No newline at end of file
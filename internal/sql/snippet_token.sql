@@ -0,0 +1,11 @@
+-- single use tokens sent by email. Only the SHA-256 hash of the token is stored
+-- so a leaked table can't be used to take over accounts.
+CREATE TABLE tokens (
+    hash CHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    scope VARCHAR(32) NOT NULL,
+    expiry TIMESTAMP NOT NULL,
+    used TIMESTAMP
+);
+
+CREATE INDEX tokens_user_idx ON tokens (user_id, scope);
@@ -3,5 +3,24 @@ CREATE TABLE users (
     name VARCHAR(255) NOT NULL,
     email VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(60) NOT NULL,
-    created TIMESTAMP NOT NULL
+    created TIMESTAMP NOT NULL,
+    role VARCHAR(16) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin')),
+    verified_at TIMESTAMP,
+    -- set by an admin, a disabled user can't log in
+    disabled_at TIMESTAMP,
+    verification_sent TIMESTAMP,
+    -- AES-GCM encrypted TOTP secret, set during enrollment and kept once enabled
+    totp_secret BYTEA,
+    totp_enabled BOOLEAN NOT NULL DEFAULT false,
+    -- last accepted TOTP time step, a code can't be used twice
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
+    -- "<issuer> <subject>" of the SSO identity linked to the account
+    oidc_subject VARCHAR(512) UNIQUE
+);
+
+CREATE TABLE recovery_codes (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    used TIMESTAMP,
+    PRIMARY KEY (user_id, code_hash)
 );
\ No newline at end of file
@@ -0,0 +1,14 @@
+-- Sessions of logged in users, the session data itself is in the sessions
+-- table managed by scs. A session is only authenticated while its row exists,
+-- deleting it signs the device out.
+CREATE TABLE user_sessions (
+    id SERIAL PRIMARY KEY,
+    token TEXT UNIQUE NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL,
+    created TIMESTAMP NOT NULL,
+    last_seen TIMESTAMP NOT NULL
+);
+
+CREATE INDEX user_sessions_user_idx ON user_sessions (user_id);
@@ -0,0 +1,24 @@
+-- one row per visitor per snippet per day, only used to deduplicate views and
+-- deleted after a day by the application.
+-- visitor is a salted hash of the client IP so no address is stored.
+CREATE TABLE snippet_view_visitor (
+    snippet_id INTEGER NOT NULL REFERENCES snippet(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    visitor CHAR(64) NOT NULL,
+    PRIMARY KEY (snippet_id, day, visitor)
+);
+
+CREATE TABLE snippet_view_daily (
+    snippet_id INTEGER NOT NULL REFERENCES snippet(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    views INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (snippet_id, day)
+);
+
+CREATE TABLE snippet_view_referrer (
+    snippet_id INTEGER NOT NULL REFERENCES snippet(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    referrer VARCHAR(255) NOT NULL,
+    views INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (snippet_id, day, referrer)
+);
@@ -0,0 +1,3 @@
+-- snippets are owned by the user who created them, older snippets stay
+-- without owner.
+ALTER TABLE snippet ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
@@ -0,0 +1,13 @@
+-- the accounts created before email verification existed are considered
+-- verified, they would otherwise lose the right to create snippets. The block
+-- only runs once, when the columns are added.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'verified_at') THEN
+        ALTER TABLE users ADD COLUMN verified_at TIMESTAMP;
+        UPDATE users SET verified_at = created;
+    END IF;
+END
+$$;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verification_sent TIMESTAMP;
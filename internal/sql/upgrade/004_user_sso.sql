@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject VARCHAR(512) UNIQUE;
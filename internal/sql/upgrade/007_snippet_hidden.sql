@@ -0,0 +1 @@
+ALTER TABLE snippet ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMP;
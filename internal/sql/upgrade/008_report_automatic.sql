@@ -0,0 +1 @@
+ALTER TABLE reports ADD COLUMN IF NOT EXISTS automatic BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,5 @@
+-- slugs were unique across all users, they only need to be unique per user
+-- since collection URLs start with the ID.
+ALTER TABLE collection DROP CONSTRAINT IF EXISTS collection_slug_key;
+DROP INDEX IF EXISTS collection_user_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS collection_user_slug_key ON collection (user_id, slug);
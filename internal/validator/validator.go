@@ -55,6 +55,16 @@ func ValueInRange(val int, val2 []int) bool {
 	return false
 }
 
+// PermittedValue() returns true if a value is in a list of permitted values.
+func PermittedValue[T comparable](value T, permittedValues ...T) bool {
+	for i := range permittedValues {
+		if value == permittedValues[i] {
+			return true
+		}
+	}
+	return false
+}
+
 // MinChars() returns true if a value contains at least n characters.
 func MinChars(value string, n int) bool {
 	return utf8.RuneCountInString(value) >= n
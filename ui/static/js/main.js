@@ -5,4 +5,152 @@ for (var i = 0; i < navLinks.length; i++) {
 		link.classList.add("live");
 		break;
 	}
-}
\ No newline at end of file
+}
+// Drag and drop reordering of the snippets in a collection. The new order is
+// kept in the hidden 'order' field of the reorder form, as a comma separated
+// list of snippet IDs.
+var sortable = document.getElementById("collection-order");
+var orderForm = document.getElementById("collection-order-form");
+if (sortable && orderForm) {
+	var dragged = null;
+
+	sortable.addEventListener("dragstart", function (e) {
+		dragged = e.target.closest("li");
+		dragged.classList.add("dragging");
+		e.dataTransfer.effectAllowed = "move";
+	});
+
+	sortable.addEventListener("dragover", function (e) {
+		e.preventDefault();
+		var target = e.target.closest("li");
+		if (!dragged || !target || target === dragged) {
+			return;
+		}
+		var box = target.getBoundingClientRect();
+		if (e.clientY > box.top + box.height / 2) {
+			target.after(dragged);
+		} else {
+			target.before(dragged);
+		}
+	});
+
+	sortable.addEventListener("dragend", function () {
+		dragged.classList.remove("dragging");
+		dragged = null;
+
+		var ids = [];
+		var items = sortable.querySelectorAll("li");
+		for (var i = 0; i < items.length; i++) {
+			ids.push(items[i].getAttribute("data-id"));
+		}
+		orderForm.elements["order"].value = ids.join(",");
+	});
+}
+
+// Passkeys (WebAuthn). The server speaks base64url for every binary field
+// while the browser API wants ArrayBuffers, so convert both ways.
+function base64urlToBuffer(value) {
+	var base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+	var binary = atob(base64);
+	var bytes = new Uint8Array(binary.length);
+	for (var i = 0; i < binary.length; i++) {
+		bytes[i] = binary.charCodeAt(i);
+	}
+	return bytes.buffer;
+}
+
+function bufferToBase64url(buffer) {
+	var bytes = new Uint8Array(buffer);
+	var binary = "";
+	for (var i = 0; i < bytes.length; i++) {
+		binary += String.fromCharCode(bytes[i]);
+	}
+	return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function postJSON(url, body) {
+	return fetch(url, {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		credentials: "same-origin",
+		body: body ? JSON.stringify(body) : null
+	}).then(function (response) {
+		return response.json().then(function (data) {
+			if (!response.ok) {
+				throw new Error(data.error || "Something went wrong");
+			}
+			return data;
+		});
+	});
+}
+
+function showPasskeyError(id, err) {
+	var el = document.getElementById(id);
+	el.textContent = err.message;
+	el.hidden = false;
+}
+
+if (window.PublicKeyCredential) {
+	var passkeyRegister = document.getElementById("passkey-register");
+	if (passkeyRegister) {
+		passkeyRegister.hidden = false;
+		passkeyRegister.querySelector("button").addEventListener("click", function () {
+			postJSON("/user/passkeys/register/begin").then(function (options) {
+				var publicKey = options.publicKey;
+				publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+				publicKey.user.id = base64urlToBuffer(publicKey.user.id);
+				(publicKey.excludeCredentials || []).forEach(function (c) {
+					c.id = base64urlToBuffer(c.id);
+				});
+				return navigator.credentials.create({publicKey: publicKey});
+			}).then(function (credential) {
+				var name = document.getElementById("passkey-name").value;
+				return postJSON("/user/passkeys/register/finish?name=" + encodeURIComponent(name), {
+					id: credential.id,
+					rawId: bufferToBase64url(credential.rawId),
+					type: credential.type,
+					response: {
+						clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+						attestationObject: bufferToBase64url(credential.response.attestationObject),
+						transports: credential.response.getTransports ? credential.response.getTransports() : []
+					}
+				});
+			}).then(function (result) {
+				window.location = result.redirect;
+			}).catch(function (err) {
+				showPasskeyError("passkey-register-error", err);
+			});
+		});
+	}
+
+	var passkeyLogin = document.getElementById("passkey-login");
+	if (passkeyLogin) {
+		passkeyLogin.hidden = false;
+		passkeyLogin.querySelector("button").addEventListener("click", function () {
+			postJSON("/user/login/passkey/begin").then(function (options) {
+				var publicKey = options.publicKey;
+				publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+				(publicKey.allowCredentials || []).forEach(function (c) {
+					c.id = base64urlToBuffer(c.id);
+				});
+				return navigator.credentials.get({publicKey: publicKey});
+			}).then(function (assertion) {
+				return postJSON("/user/login/passkey/finish", {
+					id: assertion.id,
+					rawId: bufferToBase64url(assertion.rawId),
+					type: assertion.type,
+					response: {
+						clientDataJSON: bufferToBase64url(assertion.response.clientDataJSON),
+						authenticatorData: bufferToBase64url(assertion.response.authenticatorData),
+						signature: bufferToBase64url(assertion.response.signature),
+						userHandle: assertion.response.userHandle ? bufferToBase64url(assertion.response.userHandle) : null
+					}
+				});
+			}).then(function (result) {
+				window.location = result.redirect;
+			}).catch(function (err) {
+				showPasskeyError("passkey-login-error", err);
+			});
+		});
+	}
+}